@@ -1,6 +1,8 @@
 package node
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
 	"regexp"
 	"time"
@@ -21,17 +23,32 @@ var (
 	insecure            bool // insecure upstream connection
 	port                int
 	maxConnections      int
+	maxHops             int
 	maxDownloadAttempts = 10
+	downloadWorkers     int
+	maxDownloadBacklog  int
+	downloadRetryBase   string
+	downloadRetryMax    string
 
 	gcMaxAtimeAge  string
 	gcInterval     string
 	gcMaxDiskUsage string
 
+	heartbeatInterval string
+
 	name             string
 	ipv4             string
 	dataDir          string
 	config           string
 	upstream         string
+	upstreamKind     string
+	registryMirror   bool
+	metadataTTL      string
+	keyStrategy      string
+	keyRegex         string
+	keyTTL           string
+	staleIfError     string
+	immutableRegex   string
 	proxyRegex       string
 	schedulerAddress string
 
@@ -42,34 +59,91 @@ var (
 	}
 )
 
+// Upstream as it's defined in the config file, under node.upstreams
+type upstreamOptions struct {
+	Name        string
+	Kind        string
+	Prefix      string
+	Address     string
+	Mirrors     []string
+	Insecure    bool
+	Regex       string
+	Headers     map[string]string
+	KeyStrategy string
+	KeyRegex    string
+	KeyTTL      string
+	MaxFailures int
+	Cooldown    string
+	HealthCheck struct {
+		Interval string
+		Path     string
+	}
+	StaleIfError string
+	Immutable    string
+	AuthCheck    *bool
+	AuthTTL      string
+	Username     string
+	Password     string
+	MetadataTTL  string
+	Mirror       bool
+}
+
 func CLI() {
 	Cmd.PersistentFlags().StringVarP(&config, "config", "c", "", "Config file path")
 	Cmd.PersistentFlags().StringVarP(&name, "name", "n", "", "Name of the node, defaults to hostname")
 	Cmd.PersistentFlags().StringVarP(&ipv4, "ip", "i", "", "IPV4 address of the node, that gets advertised to the scheduler")
 	Cmd.PersistentFlags().IntVarP(&port, "port", "p", 8100, "Port of the node, that gets advertised to the scheduler")
 	Cmd.PersistentFlags().IntVarP(&maxConnections, "max-conns", "m", 10, "Max connections to node")
+	Cmd.PersistentFlags().IntVar(&maxHops, "max-hops", 1, "Max peers a request can go through before falling back to the upstream, 0 to disable peers")
 	Cmd.PersistentFlags().StringVarP(&dataDir, "data-dir", "d", "/var/dcache/data", "Path to the data dir")
 	Cmd.PersistentFlags().StringVarP(&upstream, "upstream", "u", "", "URL of the upstream registry")
 	Cmd.PersistentFlags().BoolVarP(&insecure, "insecure", "k", false, "Insecure connection to upstream")
-	Cmd.PersistentFlags().StringVarP(&proxyRegex, "proxy-regex", "r", "*blob/sha256*", "Regex for the node proxy")
+	Cmd.PersistentFlags().StringVar(&upstreamKind, "upstream-kind", "generic", "Kind of upstream (generic, registry, npm, pypi, maven)")
+	Cmd.PersistentFlags().BoolVar(&registryMirror, "registry-mirror", false, "Serve the registry upstream on /v2/ too, as a registry mirror")
+	Cmd.PersistentFlags().StringVar(&metadataTTL, "metadata-ttl", "1m", "Time the metadata (registry tags, package indexes) is served without asking the upstream")
+	Cmd.PersistentFlags().StringVar(&keyStrategy, "key-strategy", "auto", "Cache key strategy (auto, etag, docker-content-digest, last-modified, url-digest, url)")
+	Cmd.PersistentFlags().StringVar(&keyRegex, "key-regex", "", "Regex used to extract the digest from the url, for the url-digest key strategy")
+	Cmd.PersistentFlags().StringVar(&keyTTL, "key-ttl", "1h", "Time to live of cached items, for the url key strategy")
+	Cmd.PersistentFlags().StringVar(&staleIfError, "stale-if-error", "0s", "Max staleness of cached items served when the upstream fails, 0s to disable")
+	Cmd.PersistentFlags().StringVar(&immutableRegex, "immutable-regex", "", "Regex of the content addressed urls served without checking the upstream, the first capture group is the digest")
+	Cmd.PersistentFlags().StringVarP(&proxyRegex, "proxy-regex", "r", ".*/blobs/sha256.*", "Regex for the node proxy, generic upstreams only")
 	Cmd.PersistentFlags().StringVarP(&schedulerAddress, "scheduler-address", "s", "", "Full http url of the scheduler")
 	Cmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Run node in verbose mode")
 	Cmd.PersistentFlags().StringVarP(&gcMaxAtimeAge, "gc-max-atime-age", "t", "12h", "Garbage collector max atime age for files")
 	Cmd.PersistentFlags().StringVarP(&gcInterval, "gc-interval", "z", "120m", "Garbage collector interval")
 	Cmd.PersistentFlags().StringVarP(&gcMaxDiskUsage, "gc-max-disk-usage", "x", "1G", "Garbage collector max dataDir size (default value 1GB)")
+	Cmd.PersistentFlags().IntVar(&downloadWorkers, "download-workers", 4, "Number of concurrent downloads")
+	Cmd.PersistentFlags().StringVar(&downloadRetryBase, "download-retry-base", "1s", "Delay of the first download retry, doubled on every attempt")
+	Cmd.PersistentFlags().StringVar(&downloadRetryMax, "download-retry-max", "5m", "Max delay between download retries")
+	Cmd.PersistentFlags().IntVar(&maxDownloadBacklog, "max-download-backlog", 10000, "Max number of downloads waiting for a free slot in the queue, beyond it they're dropped")
+	Cmd.PersistentFlags().StringVarP(&heartbeatInterval, "heartbeat-interval", "b", "10s", "Interval between node lease renewals on the scheduler")
 
 	viper.BindPFlag("node.name", Cmd.PersistentFlags().Lookup("name"))
 	viper.BindPFlag("node.ip", Cmd.PersistentFlags().Lookup("ip"))
 	viper.BindPFlag("node.port", Cmd.PersistentFlags().Lookup("port"))
+	viper.BindPFlag("node.maxHops", Cmd.PersistentFlags().Lookup("max-hops"))
 	viper.BindPFlag("node.dataDir", Cmd.PersistentFlags().Lookup("data-dir"))
 	viper.BindPFlag("node.upstream.address", Cmd.PersistentFlags().Lookup("upstream"))
 	viper.BindPFlag("node.upstream.insecure", Cmd.PersistentFlags().Lookup("insecure"))
+	viper.BindPFlag("node.upstream.kind", Cmd.PersistentFlags().Lookup("upstream-kind"))
+	viper.BindPFlag("node.upstream.mirror", Cmd.PersistentFlags().Lookup("registry-mirror"))
+	viper.BindPFlag("node.upstream.metadataTTL", Cmd.PersistentFlags().Lookup("metadata-ttl"))
+	viper.BindPFlag("node.upstream.keyStrategy", Cmd.PersistentFlags().Lookup("key-strategy"))
+	viper.BindPFlag("node.upstream.keyRegex", Cmd.PersistentFlags().Lookup("key-regex"))
+	viper.BindPFlag("node.upstream.keyTTL", Cmd.PersistentFlags().Lookup("key-ttl"))
+	viper.BindPFlag("node.upstream.staleIfError", Cmd.PersistentFlags().Lookup("stale-if-error"))
+	viper.BindPFlag("node.upstream.immutableRegex", Cmd.PersistentFlags().Lookup("immutable-regex"))
 	viper.BindPFlag("node.proxy.regex", Cmd.PersistentFlags().Lookup("proxy-regex"))
 	viper.BindPFlag("node.scheduler.address", Cmd.PersistentFlags().Lookup("scheduler-address"))
 	viper.BindPFlag("node.verbose", Cmd.PersistentFlags().Lookup("verbose"))
 	viper.BindPFlag("node.gc.maxAtimeAge", Cmd.PersistentFlags().Lookup("gc-max-atime-age"))
 	viper.BindPFlag("node.gc.interval", Cmd.PersistentFlags().Lookup("gc-interval"))
 	viper.BindPFlag("node.gc.maxDiskUsage", Cmd.PersistentFlags().Lookup("gc-max-disk-usage"))
+	viper.BindPFlag("node.heartbeat.interval", Cmd.PersistentFlags().Lookup("heartbeat-interval"))
+	viper.BindPFlag("node.downloader.workers", Cmd.PersistentFlags().Lookup("download-workers"))
+	viper.BindPFlag("node.downloader.maxBacklog", Cmd.PersistentFlags().Lookup("max-download-backlog"))
+	viper.BindPFlag("node.downloader.retryBase", Cmd.PersistentFlags().Lookup("download-retry-base"))
+	viper.BindPFlag("node.downloader.retryMax", Cmd.PersistentFlags().Lookup("download-retry-max"))
 }
 
 func argumentsMapping() {
@@ -77,18 +151,226 @@ func argumentsMapping() {
 	name = viper.Get("node.name").(string)
 	ipv4 = viper.Get("node.ip").(string)
 	port = viper.Get("node.port").(int)
+	maxHops = viper.Get("node.maxHops").(int)
 	verbose = viper.Get("node.verbose").(bool)
 	dataDir = viper.Get("node.dataDir").(string)
 	insecure = viper.Get("node.upstream.insecure").(bool)
 	upstream = viper.Get("node.upstream.address").(string)
+	upstreamKind = viper.Get("node.upstream.kind").(string)
+	registryMirror = viper.Get("node.upstream.mirror").(bool)
+	metadataTTL = viper.Get("node.upstream.metadataTTL").(string)
+	keyStrategy = viper.Get("node.upstream.keyStrategy").(string)
+	keyRegex = viper.Get("node.upstream.keyRegex").(string)
+	keyTTL = viper.Get("node.upstream.keyTTL").(string)
+	staleIfError = viper.Get("node.upstream.staleIfError").(string)
+	immutableRegex = viper.Get("node.upstream.immutableRegex").(string)
 	proxyRegex = viper.Get("node.proxy.regex").(string)
 	schedulerAddress = viper.Get("node.scheduler.address").(string)
 	gcMaxAtimeAge = viper.Get("node.gc.maxAtimeAge").(string)
 	gcMaxDiskUsage = viper.Get("node.gc.maxDiskUsage").(string)
 	gcInterval = viper.Get("node.gc.interval").(string)
+	heartbeatInterval = viper.Get("node.heartbeat.interval").(string)
+	downloadWorkers = viper.Get("node.downloader.workers").(int)
+	maxDownloadBacklog = viper.Get("node.downloader.maxBacklog").(int)
+	downloadRetryBase = viper.Get("node.downloader.retryBase").(string)
+	downloadRetryMax = viper.Get("node.downloader.retryMax").(string)
 
 }
 
+// Upstreams from the config file, if none is configured
+// the one from the command line is served on /proxy
+func upstreamsConfig() ([]*server.UpstreamConfig, error) {
+
+	var opts []upstreamOptions
+	err := viper.UnmarshalKey("node.upstreams", &opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(opts) == 0 {
+		regex := proxyRegex
+		if upstreamKind != server.KindGeneric {
+			regex = ""
+		}
+		opts = append(opts, upstreamOptions{
+			Name:         "default",
+			Kind:         upstreamKind,
+			Prefix:       "/proxy",
+			Address:      upstream,
+			Insecure:     insecure,
+			Regex:        regex,
+			KeyStrategy:  keyStrategy,
+			KeyRegex:     keyRegex,
+			KeyTTL:       keyTTL,
+			StaleIfError: staleIfError,
+			Immutable:    immutableRegex,
+			MetadataTTL:  metadataTTL,
+			Mirror:       registryMirror,
+		})
+	}
+
+	upstreams := make([]*server.UpstreamConfig, 0, len(opts))
+	for _, opt := range opts {
+		up, err := opt.upstreamConfig()
+		if err != nil {
+			return nil, fmt.Errorf("upstream %s: %v", opt.Name, err)
+		}
+		upstreams = append(upstreams, up)
+	}
+	return upstreams, nil
+}
+
+func (opt upstreamOptions) upstreamConfig() (*server.UpstreamConfig, error) {
+
+	if opt.Kind == "" {
+		opt.Kind = server.KindGeneric
+	}
+	if opt.Prefix == "" {
+		opt.Prefix = fmt.Sprintf("/%s", opt.Name)
+	}
+
+	// registry upstreams cache manifests and blobs, by digest if possible
+	if opt.Kind == server.KindRegistry {
+		if opt.Regex == "" {
+			opt.Regex = server.RegistryPaths.String()
+		}
+		if opt.Immutable == "" {
+			opt.Immutable = server.RegistryDigests.String()
+		}
+		if opt.KeyStrategy == "" {
+			opt.KeyStrategy = server.KeyDockerContentDigest
+		}
+		if opt.HealthCheck.Path == "" {
+			opt.HealthCheck.Path = "/v2/"
+		}
+	}
+
+	// package artifacts are immutable, their metadata is refreshed every metadataTTL
+	if opt.Immutable == "" {
+		switch opt.Kind {
+		case server.KindNpm:
+			opt.Immutable = server.NpmTarballs.String()
+		case server.KindPyPI:
+			opt.Immutable = server.PyPIFiles.String()
+		case server.KindMaven:
+			opt.Immutable = server.MavenArtifacts.String()
+		}
+	}
+	if opt.Regex == "" {
+		opt.Regex = ".*"
+	}
+	if opt.KeyStrategy == "" {
+		opt.KeyStrategy = server.KeyAuto
+	}
+	if opt.MetadataTTL == "" {
+		opt.MetadataTTL = "1m"
+	}
+	if opt.KeyTTL == "" {
+		opt.KeyTTL = "1h"
+	}
+	if opt.MaxFailures == 0 {
+		opt.MaxFailures = 3
+	}
+	if opt.Cooldown == "" {
+		opt.Cooldown = "30s"
+	}
+	if opt.HealthCheck.Interval == "" {
+		opt.HealthCheck.Interval = "30s"
+	}
+	if opt.HealthCheck.Path == "" {
+		opt.HealthCheck.Path = "/"
+	}
+	if opt.StaleIfError == "" {
+		opt.StaleIfError = "0s"
+	}
+	if opt.AuthCheck == nil {
+		authCheck := true
+		opt.AuthCheck = &authCheck
+	}
+	if opt.AuthTTL == "" {
+		opt.AuthTTL = "5m"
+	}
+
+	re, err := regexp.Compile(opt.Regex)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile regex: %v", err)
+	}
+	ttl, err := time.ParseDuration(opt.KeyTTL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse duration keyTTL: %v", err)
+	}
+	cooldown, err := time.ParseDuration(opt.Cooldown)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse duration cooldown: %v", err)
+	}
+	healthCheckInterval, err := time.ParseDuration(opt.HealthCheck.Interval)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse duration healthCheck.interval: %v", err)
+	}
+	staleIfError, err := time.ParseDuration(opt.StaleIfError)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse duration staleIfError: %v", err)
+	}
+	authTTL, err := time.ParseDuration(opt.AuthTTL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse duration authTTL: %v", err)
+	}
+	metadataTTL, err := time.ParseDuration(opt.MetadataTTL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse duration metadataTTL: %v", err)
+	}
+
+	var immutableRe *regexp.Regexp
+	if opt.Immutable != "" {
+		immutableRe, err = regexp.Compile(opt.Immutable)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile immutable regex: %v", err)
+		}
+		if immutableRe.NumSubexp() < 1 {
+			return nil, fmt.Errorf("immutable regex needs a capture group for the digest")
+		}
+	}
+
+	var keyRe *regexp.Regexp
+	if opt.KeyRegex != "" {
+		keyRe, err = regexp.Compile(opt.KeyRegex)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile keyRegex: %v", err)
+		}
+	}
+	if opt.KeyStrategy == server.KeyURLDigest && keyRe == nil {
+		return nil, fmt.Errorf("key strategy %s requires keyRegex", server.KeyURLDigest)
+	}
+
+	return &server.UpstreamConfig{
+		Name:        opt.Name,
+		Kind:        opt.Kind,
+		Prefix:      opt.Prefix,
+		Address:     opt.Address,
+		Mirrors:     opt.Mirrors,
+		Insecure:    opt.Insecure,
+		Regex:       re,
+		Headers:     opt.Headers,
+		KeyStrategy: opt.KeyStrategy,
+		KeyRegex:    keyRe,
+		KeyTTL:      ttl,
+		MaxFailures: opt.MaxFailures,
+		Cooldown:    cooldown,
+		HealthCheck: &server.HealthCheck{
+			Interval: healthCheckInterval,
+			Path:     opt.HealthCheck.Path,
+		},
+		StaleIfError: staleIfError,
+		Immutable:    immutableRe,
+		AuthCheck:    *opt.AuthCheck,
+		AuthTTL:      authTTL,
+		Username:     os.ExpandEnv(opt.Username),
+		Password:     os.ExpandEnv(opt.Password),
+		MetadataTTL:  metadataTTL,
+		Mirror:       opt.Mirror,
+	}, nil
+}
+
 func registerNode(c *client.Client) {
 	logrus.Info("registering node... (will retry until completed)")
 	for !client.Registered {
@@ -98,6 +380,40 @@ func registerNode(c *client.Client) {
 	logrus.Info("registration completed.")
 }
 
+// Periodically renew the node lease on the scheduler,
+// if the node has been expired register it again and advertise its items
+func heartbeat(c *client.Client, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		err := c.RenewLease()
+		if err != nil {
+			logrus.Warnln("failed to renew lease:", err)
+		}
+		if !client.Registered {
+			registerNode(c)
+			advertiseItems(c)
+		}
+	}
+}
+
+// Notify the scheduler about all the items already in the data dir
+func advertiseItems(c *client.Client) {
+	files, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		logrus.Errorln("error while reading dataDir:", err)
+		return
+	}
+	for _, fi := range files {
+		if fi.IsDir() {
+			continue
+		}
+		err := c.CreateItem(fi.Name())
+		if err != nil {
+			logrus.Warnf("failed to advertise item %s: %v", fi.Name(), err)
+		}
+	}
+}
+
 func exec(cmd *cobra.Command, args []string) {
 
 	logger := logrus.New()
@@ -134,11 +450,31 @@ func exec(cmd *cobra.Command, args []string) {
 		logrus.Errorln("failed to parse duration gcInterval")
 		os.Exit(102)
 	}
+	downloadRetryBase, err := time.ParseDuration(downloadRetryBase)
+	if err != nil {
+		logrus.Errorln("failed to parse duration downloadRetryBase")
+		os.Exit(102)
+	}
+	downloadRetryMax, err := time.ParseDuration(downloadRetryMax)
+	if err != nil {
+		logrus.Errorln("failed to parse duration downloadRetryMax")
+		os.Exit(102)
+	}
 	gcMaxDiskUsage, err := utils.ParseDataSize(gcMaxDiskUsage)
 	if err != nil {
 		logrus.Errorln("failed to parse data size:", err)
 		os.Exit(102)
 	}
+	heartbeatInterval, err := time.ParseDuration(heartbeatInterval)
+	if err != nil {
+		logrus.Errorln("failed to parse duration heartbeatInterval")
+		os.Exit(102)
+	}
+	upstreams, err := upstreamsConfig()
+	if err != nil {
+		logrus.Errorln("invalid upstreams configuration:", err)
+		os.Exit(102)
+	}
 
 	dw := downloader.NewDownloader(
 		logger.WithField("component", "node.downloader"),
@@ -147,22 +483,23 @@ func exec(cmd *cobra.Command, args []string) {
 		gcInterval,
 		gcMaxDiskUsage,
 		maxDownloadAttempts,
+		downloadWorkers,
+		maxDownloadBacklog,
+		downloadRetryBase,
+		downloadRetryMax,
 	)
 	nt := notifier.NewNotifier(dataDir, logger.WithField("component", "node.notifier"))
 	nc := client.NewClient(name, nt, schedulerAddress, logger.WithField("component", "node.client"))
 	srv := server.NewNode(
 		nc,
-		&server.UpstreamConfig{
-			Address:  upstream,
-			Insecure: insecure,
-		},
+		upstreams,
 		dataDir,
 		scheme,
 		ipv4,
 		port,
 		maxConnections,
+		maxHops,
 		dw,
-		regexp.MustCompile(proxyRegex),
 		logger.WithField("component", "node.server"),
 	)
 
@@ -174,6 +511,11 @@ func exec(cmd *cobra.Command, args []string) {
 	}
 
 	// Execution
+	err = dw.Metadata.Rebuild()
+	if err != nil {
+		logrus.Errorln("failed to load items metadata:", err)
+		os.Exit(104)
+	}
 	registerNode(nc)
 
 	logrus.Infoln("starting routines...")
@@ -181,5 +523,10 @@ func exec(cmd *cobra.Command, args []string) {
 	go nt.Run(false)    // start filesystem watcher that creates sends events to subscribers
 	go nc.NotifyItems() // Waits for events and notifies items to scheduler
 	go dw.GC.Run()      // Background routine that deletes unused files
-	srv.Run()
+	go heartbeat(nc, heartbeatInterval)
+	err = srv.Run()
+	if err != nil {
+		logrus.Errorln("failed to run node server:", err)
+		os.Exit(104)
+	}
 }
@@ -2,6 +2,7 @@ package scheduler
 
 import (
 	"os"
+	"time"
 
 	"github.com/go-playground/validator"
 	"github.com/ish-xyz/dcache/pkg/scheduler"
@@ -18,6 +19,9 @@ var (
 	algo        string
 	maxProcs    int
 	verbose     bool
+	storageOpts map[string]string
+	nodeTTL     string
+	nodeExpiry  string
 
 	Cmd = &cobra.Command{
 		Use:   "scheduler",
@@ -29,13 +33,18 @@ var (
 func CLI() {
 	Cmd.PersistentFlags().StringVarP(&config, "config", "c", "", "Config file path")
 	Cmd.PersistentFlags().StringVarP(&address, "address", "a", ":8000", "Address of the scheduler")
-	Cmd.PersistentFlags().StringVarP(&storageType, "storage-type", "s", "memory", "Backend storage for schedulers")
-	Cmd.PersistentFlags().StringVarP(&algo, "algo", "x", "LeastConnections", "Algorithm used by scheduler.")
+	Cmd.PersistentFlags().StringVarP(&storageType, "storage-type", "s", "memory", "Backend storage for schedulers (memory, redis, file)")
+	Cmd.PersistentFlags().StringToStringVarP(&storageOpts, "storage-opts", "o", map[string]string{}, "Backend storage options (e.g.: address=localhost:6379,db=0 or path=/var/dcache/scheduler.db)")
+	Cmd.PersistentFlags().StringVarP(&algo, "algo", "x", "LeastConnections", "Algorithm used by scheduler (LeastConnections, RoundRobin, WeightedRandom, Random)")
+	Cmd.PersistentFlags().StringVarP(&nodeTTL, "node-ttl", "t", "30s", "Nodes that don't renew their lease within this time are marked as unhealthy")
+	Cmd.PersistentFlags().StringVarP(&nodeExpiry, "node-expiry", "e", "5m", "Nodes that don't renew their lease within this time are deleted")
 	Cmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "Run scheduler in debug mode")
 
 	viper.BindPFlag("scheduler.address", Cmd.PersistentFlags().Lookup("address"))
 	viper.BindPFlag("scheduler.storage.type", Cmd.PersistentFlags().Lookup("storage-type"))
 	viper.BindPFlag("scheduler.algo", Cmd.PersistentFlags().Lookup("algo"))
+	viper.BindPFlag("scheduler.nodeTTL", Cmd.PersistentFlags().Lookup("node-ttl"))
+	viper.BindPFlag("scheduler.nodeExpiry", Cmd.PersistentFlags().Lookup("node-expiry"))
 	viper.BindPFlag("scheduler.verbose", Cmd.PersistentFlags().Lookup("verbose"))
 }
 
@@ -44,17 +53,35 @@ func mappping() {
 	storageType = viper.Get("scheduler.storage.type").(string)
 	algo = viper.Get("scheduler.algo").(string)
 	verbose = viper.Get("scheduler.verbose").(bool)
+	nodeTTL = viper.Get("scheduler.nodeTTL").(string)
+	nodeExpiry = viper.Get("scheduler.nodeExpiry").(string)
 	maxProcs = viper.Get("scheduler.maxProcs").(int)
 
 }
 
+// Merge storage options from the config file (scheduler.storage.*)
+// with the ones passed via CLI, CLI options take precedence
+func storageOptions() map[string]string {
+	opts := map[string]string{}
+	for k, v := range viper.GetStringMapString("scheduler.storage") {
+		if k == "type" {
+			continue
+		}
+		opts[k] = v
+	}
+	for k, v := range storageOpts {
+		opts[k] = v
+	}
+	return opts
+}
+
 func exec(cmd *cobra.Command, args []string) {
 
 	if config != "" {
 		viper.SetConfigFile(config)
 		err := viper.ReadInConfig()
 		if err != nil {
-			logrus.Errorf("fatal error reading config file: %w", err)
+			logrus.Errorf("fatal error reading config file: %v", err)
 			os.Exit(101)
 		}
 		mappping()
@@ -64,24 +91,43 @@ func exec(cmd *cobra.Command, args []string) {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
 
+	nodeTTL, err := time.ParseDuration(nodeTTL)
+	if err != nil {
+		logrus.Errorln("failed to parse duration nodeTTL")
+		os.Exit(104)
+	}
+	nodeExpiry, err := time.ParseDuration(nodeExpiry)
+	if err != nil {
+		logrus.Errorln("failed to parse duration nodeExpiry")
+		os.Exit(104)
+	}
+
 	validate := validator.New()
 
 	store, err := storage.NewStorage(
 		viper.Get("scheduler.storage.type").(string),
-		map[string]string{}, // TODO: add actual options from CLI
+		storageOptions(),
 	)
 	if err != nil {
 		logrus.Errorln(err)
 		os.Exit(102)
 	}
-	sch := scheduler.NewScheduler(
+	sch, err := scheduler.NewScheduler(
 		validate,
 		store,
 		viper.Get("scheduler.algo").(string),
+		nodeTTL,
+		nodeExpiry,
 	)
+	if err != nil {
+		logrus.Errorln(err)
+		os.Exit(103)
+	}
 	srv := scheduler.NewServer(
 		viper.Get("scheduler.address").(string),
 		sch,
 	)
+
+	go sch.RunReaper() // Background routine that expires dead nodes
 	srv.Run()
 }
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 
 	"github.com/ish-xyz/dcache/pkg/node"
 	"github.com/ish-xyz/dcache/pkg/node/notifier"
@@ -27,9 +28,10 @@ var (
 )
 
 type Response struct {
-	Status  string           `json:"status"`
-	Message string           `json:"message"`
-	Node    *node.NodeSchema `json:"node,omitempty"`
+	Status  string             `json:"status"`
+	Message string             `json:"message"`
+	Node    *node.NodeSchema   `json:"node,omitempty"`
+	Nodes   []*node.NodeSchema `json:"nodes,omitempty"`
 }
 
 type Client struct {
@@ -43,6 +45,10 @@ type Client struct {
 type IClient interface {
 	CreateNode(ipv4, scheme string, port, maxconn int) error
 	GetNode(name string) (*node.NodeSchema, error)
+	ListNodes(filters map[string]string) ([]*node.NodeSchema, error)
+	UpdateNode(name string, changes *node.NodeUpdateSchema) error
+	DeleteNode(name string) error
+	RenewLease() error
 
 	AddConnection() error
 	RemoveConnection() error
@@ -133,6 +139,48 @@ func (c *Client) CreateNode(ipv4, scheme string, port, maxconn int) error {
 	return nil
 }
 
+// renew the node lease on the scheduler,
+// if the scheduler doesn't know the node anymore the node needs to register again
+func (c *Client) RenewLease() error {
+
+	var resp Response
+
+	method := "PUT"
+	resource := "leases"
+	headers := map[string]string{"Content-Type": "application/json"}
+
+	url := fmt.Sprintf("%s/%s/%s/%s", c.SchedulerAddress, apiVersion, resource, c.Name)
+
+	c.Logger.Debugln("renewing node lease")
+
+	rawResp, err := c.Request(method, url, headers, nil)
+	if err != nil {
+		c.Logger.Debugf("error requesting url: %s", url)
+		return err
+	}
+	defer rawResp.Body.Close()
+
+	if rawResp.StatusCode == http.StatusNotFound {
+		Registered = false
+		return fmt.Errorf("node is not registered anymore")
+	}
+
+	body, _ := ioutil.ReadAll(rawResp.Body)
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		c.Logger.Debugln("error decoding payload:", err)
+		return err
+	}
+
+	if resp.Status != "success" {
+		c.Logger.Debugf("error received from scheduler: %s", resp.Message)
+		return fmt.Errorf(resp.Message)
+	}
+
+	c.Logger.Debugln("lease renewed successfully")
+	return nil
+}
+
 // add 1 node connection on the scheduler
 func (c *Client) AddConnection() error {
 
@@ -256,6 +304,134 @@ func (c *Client) GetNode(name string) (*node.NodeSchema, error) {
 	return resp.Node, nil
 }
 
+// returns the list of nodes registered on the scheduler,
+// supported filters are: healthy, available and scheme
+func (c *Client) ListNodes(filters map[string]string) ([]*node.NodeSchema, error) {
+
+	var resp Response
+
+	method := "GET"
+	resource := "nodes"
+
+	query := url.Values{}
+	for k, v := range filters {
+		query.Set(k, v)
+	}
+
+	url := fmt.Sprintf("%s/%s/%s?%s", c.SchedulerAddress, apiVersion, resource, query.Encode())
+
+	c.Logger.Debugln("listing nodes")
+
+	headers := map[string]string{
+		"Content-Type": "application/json",
+	}
+
+	rawResp, err := c.Request(method, url, headers, nil)
+	if err != nil {
+		c.Logger.Debugf("error requesting url: %s", url)
+		return nil, err
+	}
+	defer rawResp.Body.Close()
+
+	body, _ := ioutil.ReadAll(rawResp.Body)
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		c.Logger.Warnln("error decoding payload:", err)
+		return nil, err
+	}
+
+	if resp.Status != "success" {
+		c.Logger.Debugf("error received from scheduler: %s", resp.Message)
+		return nil, fmt.Errorf(resp.Message)
+	}
+
+	return resp.Nodes, nil
+}
+
+// update connection settings of a node on the scheduler
+func (c *Client) UpdateNode(name string, changes *node.NodeUpdateSchema) error {
+
+	var resp Response
+
+	method := "PUT"
+	resource := "nodes"
+	headers := map[string]string{"Content-Type": "application/json"}
+
+	if name == "self" {
+		name = c.Name
+	}
+
+	url := fmt.Sprintf("%s/%s/%s/%s", c.SchedulerAddress, apiVersion, resource, name)
+	payload, err := json.Marshal(changes)
+	if err != nil {
+		return err
+	}
+
+	c.Logger.Debugf("updating node %s with data %s", name, string(payload))
+
+	rawResp, err := c.Request(method, url, headers, payload)
+	if err != nil {
+		c.Logger.Debugf("error requesting url: %s", url)
+		return err
+	}
+	defer rawResp.Body.Close()
+
+	body, _ := ioutil.ReadAll(rawResp.Body)
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		c.Logger.Debugln("error decoding payload:", err)
+		return err
+	}
+
+	if resp.Status != "success" {
+		c.Logger.Debugf("error received from scheduler: %s", resp.Message)
+		return fmt.Errorf(resp.Message)
+	}
+	return nil
+}
+
+// delete a node and all its items from the scheduler
+func (c *Client) DeleteNode(name string) error {
+
+	var resp Response
+
+	method := "DELETE"
+	resource := "nodes"
+	headers := map[string]string{"Content-Type": "application/json"}
+
+	if name == "self" {
+		name = c.Name
+	}
+
+	url := fmt.Sprintf("%s/%s/%s/%s", c.SchedulerAddress, apiVersion, resource, name)
+
+	c.Logger.Debugf("deleting node %s", name)
+
+	rawResp, err := c.Request(method, url, headers, nil)
+	if err != nil {
+		c.Logger.Debugf("error requesting url: %s", url)
+		return err
+	}
+	defer rawResp.Body.Close()
+
+	body, _ := ioutil.ReadAll(rawResp.Body)
+	err = json.Unmarshal(body, &resp)
+	if err != nil {
+		c.Logger.Debugln("error decoding payload:", err)
+		return err
+	}
+
+	if resp.Status != "success" {
+		c.Logger.Debugf("error received from scheduler: %s", resp.Message)
+		return fmt.Errorf(resp.Message)
+	}
+
+	if name == c.Name {
+		Registered = false
+	}
+	return nil
+}
+
 // Infinite loop that waits for events and notifies the scheduler
 func (c *Client) NotifyItems() {
 	ch := make(chan *notifier.Event, 10)
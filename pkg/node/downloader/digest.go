@@ -0,0 +1,70 @@
+package downloader
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	"github.com/ish-xyz/dcache/pkg/node/metadata"
+)
+
+// Content addressed urls, e.g.: /v2/library/alpine/blobs/sha256:<digest>
+var digestRegex = regexp.MustCompile(`sha256:([a-f0-9]{64})`)
+
+// Return the expected sha256 digest of the content behind a url, if any
+func ExpectedDigest(u *url.URL) string {
+	match := digestRegex.FindStringSubmatch(u.Path)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// Verify that the item has the expected digest, if the digest of the item isn't
+// in its metadata yet (e.g.: cached by an older version) it gets computed once
+func (d *Downloader) Verify(filePath, expected string) error {
+
+	item := filepath.Base(filePath)
+	md, ok := d.Metadata.Get(item)
+	if !ok || md.Digest == "" {
+		computed, err := fileDigest(filePath)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			md = &metadata.Metadata{Item: item, Private: true}
+			if fi, err := os.Stat(filePath); err == nil {
+				md.Size = fi.Size()
+			}
+		}
+		md.Digest = computed
+		if err := d.Metadata.Write(md); err != nil {
+			d.Logger.Warnln(err)
+		}
+	}
+
+	if md.Digest != expected {
+		return fmt.Errorf("digest mismatch, wanted %s actual %s", expected, md.Digest)
+	}
+	return nil
+}
+
+func fileDigest(filePath string) (string, error) {
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, file)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
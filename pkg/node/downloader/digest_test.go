@@ -0,0 +1,42 @@
+package downloader
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ish-xyz/dcache/pkg/node/metadata"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpectedDigest(t *testing.T) {
+	digest := strings.Repeat("a", 64)
+	blobURL, _ := url.Parse(fmt.Sprintf("https://registry/v2/library/alpine/blobs/sha256:%s", digest))
+	otherURL, _ := url.Parse("https://registry/files/archive.zip")
+
+	assert.Equal(t, digest, ExpectedDigest(blobURL))
+	assert.Equal(t, "", ExpectedDigest(otherURL))
+}
+
+func TestVerify(t *testing.T) {
+	d := setupDummyDownloader()
+	myfile := fmt.Sprintf("%s/mydigest.test", downloaderTestsDir)
+	os.WriteFile(myfile, []byte("some content"), 0644)
+	// sha256 of "some content"
+	digest := "290f493c44f5d63d06b374d0a5abd292fae38b92cab2fae5efefe1b0e9347f56"
+
+	okErr := d.Verify(myfile, digest)
+	md, stored := d.Metadata.Get("mydigest.test")
+	d.Metadata.Write(&metadata.Metadata{Item: "mydigest.test", Size: 12, Digest: strings.Repeat("0", 64)})
+	knownErr := d.Verify(myfile, digest)
+
+	assert.Nil(t, okErr)
+	assert.True(t, stored)
+	assert.Equal(t, digest, md.Digest)
+	assert.NotNil(t, knownErr)
+
+	os.Remove(myfile)
+	d.Metadata.Delete("mydigest.test")
+}
@@ -1,14 +1,20 @@
 package downloader
 
 import (
+	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
+	"github.com/ish-xyz/dcache/pkg/node/metadata"
 	"github.com/sirupsen/logrus"
 )
 
@@ -16,28 +22,114 @@ var (
 	killswitch KillSwitch
 )
 
+// Dead letters kept in memory, the oldest ones are discarded
+const maxDeadLetters = 1000
+
 type KillSwitch struct {
 	Trigger bool
 	mu      sync.Mutex
 }
 
+func (k *KillSwitch) enabled() bool {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.Trigger
+}
+
 type Downloader struct {
-	Stack       chan *Item    `validate:"required"`
-	Client      *http.Client  `validate:"required"`
-	Logger      *logrus.Entry `validate:"required"`
-	GC          *GC           `validate:"required"`
+	Stack       chan *Item      `validate:"required"`
+	Client      *http.Client    `validate:"required"`
+	Logger      *logrus.Entry   `validate:"required"`
+	GC          *GC             `validate:"required"`
+	Metadata    *metadata.Store `validate:"required"`
 	DryRun      bool
-	MaxAttempts int `validate:"required"`
+	MaxAttempts int           `validate:"required"`
+	Workers     int           `validate:"required,min=1"` // concurrent downloads
+	MaxBacklog  int           `validate:"min=0"`          // items queued on top of the stack, beyond it they're dropped
+	RetryBase   time.Duration `validate:"min=0"`          // delay of the first retry, doubled on every attempt
+	RetryMax    time.Duration `validate:"min=0"`          // max delay between retries
+	Journal     *Journal      `validate:"required"`
+	mu          sync.Mutex
+	pending     map[string]*Handle // items queued or in flight, keyed by file path
+	queueMu     sync.Mutex
+	backlog     []*Item // items waiting for room in the stack, oldest first
+	dropped     int64
+	delayed     int          // items waiting for their retry
+	deadLetters []DeadLetter // items the downloader gave up on
+}
+
+// Item that failed for good, either with a permanent error or after MaxAttempts
+type DeadLetter struct {
+	Item      string    `json:"item"`
+	URL       string    `json:"url"`
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error"`
+	Permanent bool      `json:"permanent"`
+	FailedAt  time.Time `json:"failedAt"`
+}
+
+// Status of the download queue
+type QueueStats struct {
+	Queued  int   `json:"queued"`
+	Backlog int   `json:"backlog"`
+	Delayed int   `json:"delayed"`
+	Pending int   `json:"pending"`
+	Dropped int64 `json:"dropped"`
 }
 
 type Item struct {
-	Req      *http.Request
-	FilePath string
-	Attempts int
+	Req       *http.Request
+	FilePath  string
+	Attempts  int
+	Validator string       // ETag or Last-Modified of the partial download, used with If-Range
+	Client    *http.Client // used instead of the downloader client, if set
+	RetryAt   time.Time    // the item isn't downloaded before
+	handle    *Handle
+}
+
+// Returned by Push, completed once the item is downloaded or the downloader gives up on it
+type Handle struct {
+	done chan struct{}
+	err  error
+}
+
+// Closed when the item is completed
+func (h *Handle) Done() <-chan struct{} {
+	return h.done
+}
+
+// Wait for the item to be completed, returns the last download error if it failed
+func (h *Handle) Wait() error {
+	<-h.done
+	return h.err
+}
+
+// Failures that don't go away by retrying (e.g.: 404, 403)
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+func isPermanent(err error) bool {
+	var perm *permanentError
+	return errors.As(err, &perm)
+}
+
+// Timeouts and rate limiting are retried, other client errors are permanent
+func retryableStatus(code int) bool {
+	return code >= 500 || code == http.StatusRequestTimeout || code == http.StatusTooManyRequests
 }
 
-func NewDownloader(log *logrus.Entry, dataDir string, maxAtime, interval time.Duration, maxDiskUsage, maxAttempts int) *Downloader {
+func NewDownloader(log *logrus.Entry, dataDir string, maxAtime, interval time.Duration, maxDiskUsage, maxAttempts, workers, maxBacklog int, retryBase, retryMax time.Duration) *Downloader {
 
+	store := metadata.NewStore(dataDir, log.WithField("component", "node.metadata"))
 	cache := &FilesCache{
 		AtimeStore: make(map[string]int64),
 		FilesByAge: make([]string, 1),
@@ -51,83 +143,448 @@ func NewDownloader(log *logrus.Entry, dataDir string, maxAtime, interval time.Du
 		DataDir:      dataDir,
 		Logger:       log.WithField("component", "node.downloader.gc"),
 		Cache:        cache,
+		Metadata:     store,
 		DryRun:       false,
 	}
 
 	return &Downloader{
-		Stack:  make(chan *Item, 100),
-		Logger: log,
-		Client: &http.Client{},
-		GC:     gc,
-		DryRun: false,
+		Stack:       make(chan *Item, 100),
+		Logger:      log,
+		Client:      &http.Client{},
+		GC:          gc,
+		Metadata:    store,
+		DryRun:      false,
+		MaxAttempts: maxAttempts,
+		Workers:     workers,
+		MaxBacklog:  maxBacklog,
+		RetryBase:   retryBase,
+		RetryMax:    retryMax,
+		Journal:     NewJournal(dataDir, log.WithField("component", "node.downloader.journal")),
+		pending:     make(map[string]*Handle),
 	}
 }
 
-func (d *Downloader) Push(req *http.Request, filepath string) error {
-	it := &Item{
+func (d *Downloader) Push(req *http.Request, filepath string) (*Handle, error) {
+	return d.PushWithClient(req, filepath, nil)
+}
+
+// Push an item that has to be downloaded with a specific client (e.g.: custom TLS settings).
+// If the item is already queued or in flight, the handle of the existing download is returned
+func (d *Downloader) PushWithClient(req *http.Request, filepath string, client *http.Client) (*Handle, error) {
+	return d.push(&Item{
 		Req:      req,
 		FilePath: filepath,
+		Client:   client,
+	})
+}
+
+func (d *Downloader) push(it *Item) (*Handle, error) {
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if handle, ok := d.pending[it.FilePath]; ok {
+		d.Logger.Debugf("item %s already queued", it.FilePath)
+		return handle, nil
 	}
-	select {
-	case d.Stack <- it:
+
+	// the item is journaled before being queued, so that a crash can't lose it
+	err := d.Journal.Write(it)
+	if err != nil {
+		d.Logger.Warnln(err)
+	}
+
+	it.handle = &Handle{done: make(chan struct{})}
+	err = d.schedule(it, time.Until(it.RetryAt))
+	if err != nil {
+		d.Journal.Delete(it.FilePath)
+		return nil, err
+	}
+	d.pending[it.FilePath] = it.handle
+	return it.handle, nil
+}
+
+// Push the items left in the journal by a previous run, clientFor returns
+// the client of the upstream that serves the request (nil for the default one)
+func (d *Downloader) Replay(clientFor func(*http.Request) *http.Client) (int, error) {
+
+	entries, err := d.Journal.Load()
+	if err != nil {
+		return 0, err
+	}
+
+	replayed := 0
+	for _, entry := range entries {
+		req, err := entry.request()
+		if err != nil {
+			d.Logger.Warnf("invalid queue entry for %s, discarding it: %v", entry.FilePath, err)
+			d.Journal.Delete(entry.FilePath)
+			continue
+		}
+		if _, err := os.Stat(entry.FilePath); err == nil {
+			d.Logger.Debugf("item %s already downloaded, discarding queue entry", entry.FilePath)
+			d.Journal.Delete(entry.FilePath)
+			continue
+		}
+
+		_, err = d.push(&Item{
+			Req:       req,
+			FilePath:  entry.FilePath,
+			Attempts:  entry.Attempts,
+			Validator: entry.Validator,
+			Client:    clientFor(req),
+			RetryAt:   entry.retryAt(),
+		})
+		if err != nil {
+			d.Logger.Warnf("failed to replay download of %s: %v", entry.FilePath, err)
+			continue
+		}
+		replayed++
+	}
+	return replayed, nil
+}
+
+// Complete the item, so that it can be pushed again
+func (d *Downloader) finish(item *Item, err error) {
+
+	d.mu.Lock()
+	if d.pending[item.FilePath] == item.handle {
+		delete(d.pending, item.FilePath)
+		d.Journal.Delete(item.FilePath)
+	}
+	d.mu.Unlock()
+
+	if item.handle != nil {
+		item.handle.err = err
+		close(item.handle.done)
+	}
+}
+
+// Push an existing item, keeping its attempts and partial download.
+// When the stack is full the item waits in the backlog, if that's full too it's dropped
+func (d *Downloader) requeue(it *Item) error {
+
+	d.queueMu.Lock()
+	defer d.queueMu.Unlock()
+
+	// items in the backlog go first
+	if len(d.backlog) == 0 {
+		select {
+		case d.Stack <- it:
+			return nil
+		default:
+		}
+	}
+
+	if len(d.backlog) < d.MaxBacklog {
+		d.backlog = append(d.backlog, it)
 		return nil
-	default:
-		return fmt.Errorf("buffer is full")
 	}
+
+	d.dropped++
+	d.Logger.Warnf("download queue is full, dropping item %s", it.FilePath)
+	return fmt.Errorf("buffer is full")
+}
+
+// Push the item once the delay expires, the item is completed if it can't be queued
+func (d *Downloader) schedule(it *Item, delay time.Duration) error {
+
+	if delay <= 0 {
+		return d.requeue(it)
+	}
+
+	d.queueMu.Lock()
+	d.delayed++
+	d.queueMu.Unlock()
+
+	time.AfterFunc(delay, func() {
+		d.queueMu.Lock()
+		d.delayed--
+		d.queueMu.Unlock()
+
+		if err := d.requeue(it); err != nil {
+			d.finish(it, err)
+		}
+	})
+	return nil
+}
+
+// Exponential backoff with jitter, so that items that failed together aren't retried together
+func (d *Downloader) backoff(attempts int) time.Duration {
+
+	if d.RetryBase <= 0 {
+		return 0
+	}
+
+	delay := d.RetryBase
+	for i := 1; i < attempts && (d.RetryMax <= 0 || delay < d.RetryMax); i++ {
+		delay *= 2
+	}
+	if d.RetryMax > 0 && delay > d.RetryMax {
+		delay = d.RetryMax
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// Retry a failed item after the backoff, or give up on it
+func (d *Downloader) retry(item *Item, err error) {
+
+	if isPermanent(err) || item.Attempts > d.MaxAttempts {
+		d.Logger.Errorf("giving up on item %s after %d attempts", item.FilePath, item.Attempts+1)
+		os.Remove(partialPath(item.FilePath))
+		d.deadLetter(item, err)
+		d.finish(item, err)
+		return
+	}
+
+	item.Attempts += 1
+	delay := d.backoff(item.Attempts)
+	item.RetryAt = time.Now().Add(delay)
+	if journalErr := d.Journal.Write(item); journalErr != nil {
+		d.Logger.Warnln(journalErr)
+	}
+
+	d.Logger.Infof("retrying download of %s in %s", item.FilePath, delay)
+	if scheduleErr := d.schedule(item, delay); scheduleErr != nil {
+		d.finish(item, err)
+	}
+}
+
+func (d *Downloader) deadLetter(item *Item, err error) {
+
+	d.queueMu.Lock()
+	defer d.queueMu.Unlock()
+
+	if len(d.deadLetters) >= maxDeadLetters {
+		d.deadLetters = d.deadLetters[1:]
+	}
+	d.deadLetters = append(d.deadLetters, DeadLetter{
+		Item:      filepath.Base(item.FilePath),
+		URL:       item.Req.URL.String(),
+		Attempts:  item.Attempts + 1,
+		Error:     err.Error(),
+		Permanent: isPermanent(err),
+		FailedAt:  time.Now(),
+	})
+}
+
+// Items the downloader gave up on, oldest first
+func (d *Downloader) DeadLetters() []DeadLetter {
+
+	d.queueMu.Lock()
+	defer d.queueMu.Unlock()
+
+	letters := make([]DeadLetter, len(d.deadLetters))
+	copy(letters, d.deadLetters)
+	return letters
+}
+
+func (d *Downloader) ClearDeadLetters() {
+	d.queueMu.Lock()
+	d.deadLetters = nil
+	d.queueMu.Unlock()
+}
+
+// Move the oldest item of the backlog into the stack, if there's room
+func (d *Downloader) refill() {
+
+	d.queueMu.Lock()
+	defer d.queueMu.Unlock()
+
+	for len(d.backlog) > 0 {
+		select {
+		case d.Stack <- d.backlog[0]:
+			d.backlog[0] = nil
+			d.backlog = d.backlog[1:]
+		default:
+			return
+		}
+	}
+}
+
+func (d *Downloader) Stats() QueueStats {
+
+	d.queueMu.Lock()
+	stats := QueueStats{
+		Queued:  len(d.Stack),
+		Backlog: len(d.backlog),
+		Delayed: d.delayed,
+		Dropped: d.dropped,
+	}
+	d.queueMu.Unlock()
+
+	d.mu.Lock()
+	stats.Pending = len(d.pending)
+	d.mu.Unlock()
+	return stats
 }
 
 func (d *Downloader) Pop(wait bool) (*Item, error) {
 	if wait {
-		return <-d.Stack, nil
+		it := <-d.Stack
+		d.refill()
+		return it, nil
 	}
 
 	select {
 	case it := <-d.Stack:
+		d.refill()
 		return it, nil
 	default:
 		return nil, fmt.Errorf("empty queue")
 	}
 }
 
+// Partial downloads are kept across attempts, so that they can be resumed
+func partialPath(filePath string) string {
+	return filepath.Join(filepath.Dir(filePath), fmt.Sprintf(".%s.part", filepath.Base(filePath)))
+}
+
 func (d *Downloader) download(item *Item) error {
 
-	tmpFilePath := fmt.Sprintf("/tmp/%s", filepath.Base(item.FilePath))
-	resp, err := d.Client.Do(item.Req)
+	partFilePath := partialPath(item.FilePath)
+	req := item.Req.Clone(item.Req.Context())
+	req.Header.Del("Range")
+	req.Header.Del("If-Range")
+
+	// resume the partial download, if the item changed upstream
+	// If-Range makes the server send the whole item again
+	var offset int64
+	if fi, err := os.Stat(partFilePath); err == nil && fi.Size() > 0 && item.Validator != "" {
+		offset = fi.Size()
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", item.Validator)
+		d.Logger.Debugf("resuming download of %s from byte %d", item.FilePath, offset)
+	}
+
+	client := d.Client
+	if item.Client != nil {
+		client = item.Client
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return fmt.Errorf("request error: %v", err)
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("received non 200 status code while trying to download %s", item.Req.URL.String())
+	flags := os.O_CREATE | os.O_WRONLY
+	size := resp.ContentLength
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		offset = 0
+		flags |= os.O_TRUNC
+	case http.StatusPartialContent:
+		start, total, err := parseContentRange(resp.Header.Get("Content-Range"))
+		if err != nil || start != offset {
+			os.Remove(partFilePath)
+			return fmt.Errorf("invalid content range %s for %s", resp.Header.Get("Content-Range"), item.Req.URL.String())
+		}
+		flags |= os.O_APPEND
+		size = total
+	case http.StatusRequestedRangeNotSatisfiable:
+		os.Remove(partFilePath)
+		return fmt.Errorf("partial download of %s is not valid anymore", item.Req.URL.String())
+	default:
+		err := fmt.Errorf("received status code %d while trying to download %s", resp.StatusCode, item.Req.URL.String())
+		if !retryableStatus(resp.StatusCode) {
+			return &permanentError{err}
+		}
+		return err
 	}
 
-	file, err := os.Create(tmpFilePath)
+	// weak validators can't be used with If-Range
+	item.Validator = resp.Header.Get("Last-Modified")
+	if etag := resp.Header.Get("Etag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		item.Validator = etag
+	}
+
+	// the digest of a resumed download includes the partial content
+	h := sha256.New()
+	if offset > 0 {
+		partial, err := os.Open(partFilePath)
+		if err != nil {
+			return fmt.Errorf("failed to open temporary file: %v", err)
+		}
+		_, err = io.CopyN(h, partial, offset)
+		partial.Close()
+		if err != nil {
+			os.Remove(partFilePath)
+			return fmt.Errorf("failed to read partial download: %v", err)
+		}
+	}
+
+	file, err := os.OpenFile(partFilePath, flags, 0644)
 	if err != nil {
-		return fmt.Errorf("failed to create new empty temporary file: %v", err)
+		return fmt.Errorf("failed to open temporary file: %v", err)
 	}
-	defer file.Close()
 
-	size, err := io.Copy(file, resp.Body)
+	written, err := io.Copy(io.MultiWriter(file, h), resp.Body)
+	file.Close()
 	if err != nil {
 		return fmt.Errorf("failed to memory copy into file: %v", err)
 	}
 
-	err = os.Rename(tmpFilePath, item.FilePath)
+	if size >= 0 && offset+written != size {
+		os.Remove(partFilePath)
+		return fmt.Errorf("size mismatch, wanted %d actual %d", size, offset+written)
+	}
+
+	digest := fmt.Sprintf("%x", h.Sum(nil))
+	if expected := ExpectedDigest(item.Req.URL); expected != "" && digest != expected {
+		os.Remove(partFilePath)
+		return fmt.Errorf("digest mismatch, wanted %s actual %s", expected, digest)
+	}
+
+	err = os.Rename(partFilePath, item.FilePath)
 	if err != nil {
 		return fmt.Errorf("failed to rename temporary file: %v", err)
 	}
 
-	if resp.Header.Get("content-length") != fmt.Sprintf("%d", size) {
-		return fmt.Errorf("size mismatch, wanted %s actual %s", resp.Header.Get("content-length"), fmt.Sprintf("%d", size))
+	err = d.Metadata.Write(&metadata.Metadata{
+		Item:    filepath.Base(item.FilePath),
+		URL:     item.Req.URL.String(),
+		Size:    offset + written,
+		Digest:  digest,
+		Header:  metadata.FilterHeader(resp.Header),
+		Private: req.Header.Get("Authorization") != "",
+	})
+	if err != nil {
+		d.Logger.Warnln(err)
 	}
+	return nil
+}
+
+// Parse "bytes <start>-<end>/<total>", total is -1 if unknown
+func parseContentRange(header string) (start, total int64, err error) {
+
+	var end int64
+	var totalStr string
 
-	return err
+	_, err = fmt.Sscanf(header, "bytes %d-%d/%s", &start, &end, &totalStr)
+	if err != nil {
+		return 0, 0, err
+	}
+	if totalStr == "*" {
+		return start, -1, nil
+	}
+	total, err = strconv.ParseInt(totalStr, 10, 64)
+	return start, total, err
 }
 
+// Start the workers, in dry run a single item is processed by the caller
 func (d *Downloader) Run() {
+	if !d.DryRun {
+		for i := 1; i < d.Workers; i++ {
+			go d.work()
+		}
+	}
+	d.work()
+}
+
+func (d *Downloader) work() {
 	for {
-		if killswitch.Trigger {
+		if killswitch.enabled() {
 			d.Logger.Warningln("kill switch enabled, unable to download new files")
 		} else {
 			lastItem, _ := d.Pop(true)
@@ -138,16 +595,15 @@ func (d *Downloader) Run() {
 				d.Logger.Errorf("failed to download item %s with error: %v", lastItem.FilePath, err)
 				if _, statErr := os.Stat(lastItem.FilePath); statErr == nil {
 					d.Logger.Infof("removing file %s", lastItem.FilePath)
-					err = os.Remove(lastItem.FilePath)
-					if err != nil {
-						d.Logger.Errorf("failed to delete corrupt file %s with error %v", lastItem.FilePath, err)
+					removeErr := os.Remove(lastItem.FilePath)
+					if removeErr != nil {
+						d.Logger.Errorf("failed to delete corrupt file %s with error %v", lastItem.FilePath, removeErr)
 					}
+					d.Metadata.Delete(filepath.Base(lastItem.FilePath))
 				}
-				// Push back into the queue to retry
-				if lastItem.Attempts <= d.MaxAttempts {
-					lastItem.Attempts += 1
-					d.Push(lastItem.Req, lastItem.FilePath)
-				}
+				d.retry(lastItem, err)
+			} else {
+				d.finish(lastItem, nil)
 			}
 		}
 
@@ -6,6 +6,7 @@ import (
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
@@ -28,6 +29,10 @@ func setupDummyDownloader() *Downloader {
 		interval,
 		10*1024*1024*1024,
 		10,
+		1,
+		100,
+		0,
+		0,
 	)
 	return d
 }
@@ -138,3 +143,187 @@ func TestRunDownloadFailedRetry(t *testing.T) {
 	assert.Equal(t, 1, len(d.Stack))
 	os.Remove(myfile)
 }
+
+func TestDownloadResume(t *testing.T) {
+
+	d := setupDummyDownloader()
+	myfile := fmt.Sprintf("%s/myresume.test", downloaderTestsDir)
+	content := "some content to resume"
+	os.WriteFile(partialPath(myfile), []byte(content[:5]), 0644)
+
+	var rangeHeader string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rangeHeader = r.Header.Get("Range")
+		w.Header().Set("Etag", `"v1"`)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+	}))
+	myreq, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	err := d.download(&Item{Req: myreq, FilePath: myfile, Validator: `"v1"`})
+	data, readErr := os.ReadFile(myfile)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "bytes=5-", rangeHeader)
+	assert.Nil(t, readErr)
+	assert.Equal(t, content, string(data))
+
+	os.Remove(myfile)
+}
+
+func TestDownloadResumeChangedItem(t *testing.T) {
+
+	d := setupDummyDownloader()
+	myfile := fmt.Sprintf("%s/myresume.test", downloaderTestsDir)
+	content := "new content"
+	os.WriteFile(partialPath(myfile), []byte("old"), 0644)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Etag", `"v2"`)
+		http.ServeContent(w, r, "", time.Time{}, strings.NewReader(content))
+	}))
+	myreq, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	item := &Item{Req: myreq, FilePath: myfile, Validator: `"v1"`}
+	err := d.download(item)
+	data, _ := os.ReadFile(myfile)
+
+	assert.Nil(t, err)
+	assert.Equal(t, content, string(data))
+	assert.Equal(t, `"v2"`, item.Validator)
+
+	os.Remove(myfile)
+}
+
+func TestDownloadDigestMismatch(t *testing.T) {
+
+	d := setupDummyDownloader()
+	myfile := fmt.Sprintf("%s/mydigest.test", downloaderTestsDir)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "corrupted layer")
+	}))
+	myreq, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v2/test/blobs/sha256:%s", srv.URL, strings.Repeat("a", 64)), nil)
+	err := d.download(&Item{Req: myreq, FilePath: myfile})
+	_, statErr := os.Stat(myfile)
+	_, partErr := os.Stat(partialPath(myfile))
+
+	assert.NotNil(t, err)
+	assert.NotNil(t, statErr)
+	assert.NotNil(t, partErr)
+}
+
+func TestPushDedup(t *testing.T) {
+
+	d := setupDummyDownloader()
+	myreq, _ := http.NewRequest(http.MethodGet, "https://null.null", nil)
+
+	first, firstErr := d.Push(myreq, "/tmp/mydatadir/mydedup")
+	second, secondErr := d.Push(myreq, "/tmp/mydatadir/mydedup")
+	other, otherErr := d.Push(myreq, "/tmp/mydatadir/myother")
+
+	assert.Nil(t, firstErr)
+	assert.Nil(t, secondErr)
+	assert.Nil(t, otherErr)
+	assert.Equal(t, first, second)
+	assert.NotEqual(t, first, other)
+	assert.Equal(t, 2, len(d.Stack))
+
+	// completed items can be pushed again
+	it, _ := d.Pop(false)
+	d.finish(it, nil)
+	third, _ := d.Push(myreq, "/tmp/mydatadir/mydedup")
+
+	assert.NotEqual(t, first, third)
+	assert.Nil(t, first.Wait())
+}
+
+func TestRunWorkers(t *testing.T) {
+
+	d := setupDummyDownloader()
+	d.Workers = 3
+	killswitch.mu.Lock()
+	killswitch.Trigger = false
+	killswitch.mu.Unlock()
+
+	// each request waits for the others, they complete only if they run concurrently
+	arrived := make(chan struct{}, d.Workers)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- struct{}{}
+		for len(arrived) < d.Workers {
+			time.Sleep(10 * time.Millisecond)
+		}
+		fmt.Fprintf(w, "content of %s", r.URL.Path)
+	}))
+	defer srv.Close()
+
+	var handles []*Handle
+	for i := 0; i < d.Workers; i++ {
+		myreq, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/%d", srv.URL, i), nil)
+		handle, err := d.Push(myreq, fmt.Sprintf("%s/myworker%d.test", downloaderTestsDir, i))
+		assert.Nil(t, err)
+		handles = append(handles, handle)
+	}
+	go d.Run()
+
+	for i, handle := range handles {
+		select {
+		case <-handle.Done():
+			assert.Nil(t, handle.Wait())
+		case <-time.After(5 * time.Second):
+			t.Fatalf("download %d not completed", i)
+		}
+		os.Remove(fmt.Sprintf("%s/myworker%d.test", downloaderTestsDir, i))
+	}
+}
+
+func TestHandleWaitFailed(t *testing.T) {
+
+	d := setupDummyDownloader()
+	d.MaxAttempts = 0
+	d.DryRun = true
+	killswitch.mu.Lock()
+	killswitch.Trigger = false
+	killswitch.mu.Unlock()
+	myfile := fmt.Sprintf("%s/myfailed.test", downloaderTestsDir)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer srv.Close()
+	myreq, _ := http.NewRequest(http.MethodGet, srv.URL, nil)
+	handle, _ := d.Push(myreq, myfile)
+
+	// the first failure is retried once
+	d.Run()
+	d.Run()
+
+	assert.NotNil(t, handle.Wait())
+	assert.Equal(t, 0, len(d.Stack))
+}
+
+func TestPushBacklog(t *testing.T) {
+
+	d := setupDummyDownloader()
+	d.Stack = make(chan *Item, 1)
+	d.MaxBacklog = 1
+	d.Journal = &Journal{Dir: t.TempDir(), Logger: d.Logger}
+	myreq, _ := http.NewRequest(http.MethodGet, "https://null.null", nil)
+
+	_, firstErr := d.Push(myreq, "/tmp/mydatadir/myfirst")
+	_, secondErr := d.Push(myreq, "/tmp/mydatadir/mysecond")
+	_, droppedErr := d.Push(myreq, "/tmp/mydatadir/mydropped")
+	stats := d.Stats()
+	entries, _ := d.Journal.Load()
+
+	assert.Nil(t, firstErr)
+	assert.Nil(t, secondErr)
+	assert.NotNil(t, droppedErr)
+	assert.Equal(t, QueueStats{Queued: 1, Backlog: 1, Pending: 2, Dropped: 1}, stats)
+	assert.Equal(t, 2, len(entries))
+
+	// items leave the backlog in order, once there's room in the stack
+	first, _ := d.Pop(false)
+	second, _ := d.Pop(false)
+
+	assert.Equal(t, "/tmp/mydatadir/myfirst", first.FilePath)
+	assert.Equal(t, "/tmp/mydatadir/mysecond", second.FilePath)
+	assert.Equal(t, 0, d.Stats().Backlog)
+}
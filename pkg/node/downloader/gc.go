@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"time"
 
+	"github.com/ish-xyz/dcache/pkg/node/metadata"
 	"github.com/sirupsen/logrus"
 )
 
@@ -22,6 +23,7 @@ type GC struct {
 	MaxDiskUsage int           `validate:"required"`
 	DataDir      string        `validate:"required"`
 	Cache        *FilesCache   `validate:"required"`
+	Metadata     *metadata.Store
 	Logger       *logrus.Entry `validate:"required"`
 	DryRun       bool
 }
@@ -83,6 +85,7 @@ func (gc *GC) Run() {
 					continue
 				}
 				delete(gc.Cache.AtimeStore, fi.Name())
+				gc.deleteMetadata(fi.Name())
 				continue
 			}
 		}
@@ -109,6 +112,16 @@ func (gc *GC) Run() {
 	}
 }
 
+func (gc *GC) deleteMetadata(item string) {
+	if gc.Metadata == nil {
+		return
+	}
+	err := gc.Metadata.Delete(item)
+	if err != nil {
+		gc.Logger.Errorf("failed to remove metadata of %s, error: %v", item, err)
+	}
+}
+
 func (gc *GC) cleanDataDir() error {
 
 	for _, file := range gc.Cache.FilesByAge {
@@ -117,6 +130,7 @@ func (gc *GC) cleanDataDir() error {
 			gc.Logger.Errorf("failed to remove file %s", file)
 			continue
 		}
+		gc.deleteMetadata(file)
 
 		gc.Cache.FilesByAge = gc.Cache.FilesByAge[1:]
 		if gc.dataDirSize() < float64(gc.MaxDiskUsage) {
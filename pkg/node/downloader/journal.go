@@ -0,0 +1,155 @@
+package downloader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const journalExt = ".json"
+
+// Queued downloads, persisted so that they survive a restart. Each entry is a json
+// file in <dataDir>/.queue, hidden to the notifier. The entries contain the headers
+// of the request (credentials included) so they're readable only by the node
+type Journal struct {
+	Dir    string        `validate:"required"`
+	Logger *logrus.Entry `validate:"required"`
+}
+
+type JournalEntry struct {
+	FilePath  string      `json:"filePath"`
+	URL       string      `json:"url"`
+	Host      string      `json:"host,omitempty"`
+	Header    http.Header `json:"header,omitempty"`
+	Attempts  int         `json:"attempts"`
+	Validator string      `json:"validator,omitempty"`
+	QueuedAt  int64       `json:"queuedAt"`
+	RetryAt   int64       `json:"retryAt,omitempty"`
+}
+
+func NewJournal(dataDir string, log *logrus.Entry) *Journal {
+	return &Journal{
+		Dir:    filepath.Join(dataDir, ".queue"),
+		Logger: log,
+	}
+}
+
+func (j *Journal) entryPath(filePath string) string {
+	return filepath.Join(j.Dir, filepath.Base(filePath)+journalExt)
+}
+
+// Write the entry of a queued item, replacing the previous one
+func (j *Journal) Write(item *Item) error {
+
+	entry := &JournalEntry{
+		FilePath:  item.FilePath,
+		URL:       item.Req.URL.String(),
+		Host:      item.Req.Host,
+		Header:    item.Req.Header,
+		Attempts:  item.Attempts,
+		Validator: item.Validator,
+		QueuedAt:  time.Now().Unix(),
+	}
+	if !item.RetryAt.IsZero() {
+		entry.RetryAt = item.RetryAt.Unix()
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(j.Dir, 0700)
+	if err != nil {
+		return fmt.Errorf("failed to create queue dir: %v", err)
+	}
+
+	// rename is atomic, a crash never leaves a truncated entry
+	tmp := j.entryPath(item.FilePath) + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write queue entry of %s: %v", item.FilePath, err)
+	}
+	err = os.Rename(tmp, j.entryPath(item.FilePath))
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write queue entry of %s: %v", item.FilePath, err)
+	}
+	return nil
+}
+
+func (j *Journal) Delete(filePath string) error {
+	err := os.Remove(j.entryPath(filePath))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Return the entries of the journal, oldest first. Invalid entries are removed
+func (j *Journal) Load() ([]*JournalEntry, error) {
+
+	files, err := ioutil.ReadDir(j.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error while reading queue dir: %v", err)
+	}
+
+	entries := make([]*JournalEntry, 0, len(files))
+	for _, fi := range files {
+		path := filepath.Join(j.Dir, fi.Name())
+		if !strings.HasSuffix(fi.Name(), journalExt) {
+			os.Remove(path)
+			continue
+		}
+
+		entry := &JournalEntry{}
+		data, err := ioutil.ReadFile(path)
+		if err == nil {
+			err = json.Unmarshal(data, entry)
+		}
+		if err != nil || entry.FilePath == "" || entry.URL == "" {
+			j.Logger.Warnf("invalid queue entry %s, discarding it", path)
+			os.Remove(path)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+
+	sort.SliceStable(entries, func(i, k int) bool {
+		return entries[i].QueuedAt < entries[k].QueuedAt
+	})
+	return entries, nil
+}
+
+// Rebuild the request of the entry
+func (e *JournalEntry) request() (*http.Request, error) {
+
+	req, err := http.NewRequest(http.MethodGet, e.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if e.Header != nil {
+		req.Header = e.Header
+	}
+	if e.Host != "" {
+		req.Host = e.Host
+	}
+	return req, nil
+}
+
+func (e *JournalEntry) retryAt() time.Time {
+	if e.RetryAt == 0 {
+		return time.Time{}
+	}
+	return time.Unix(e.RetryAt, 0)
+}
@@ -0,0 +1,61 @@
+package downloader
+
+import (
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestJournalReplay(t *testing.T) {
+
+	d := setupDummyDownloader()
+	d.Journal = &Journal{Dir: t.TempDir(), Logger: d.Logger}
+	myreq, _ := http.NewRequest(http.MethodGet, "https://null.null/myfile", nil)
+	myreq.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+	myfile := filepath.Join(downloaderTestsDir, "myjournaled")
+	d.Push(myreq, myfile)
+	it, _ := d.Pop(false)
+	it.Attempts = 2
+	it.Validator = `"v1"`
+	d.Journal.Write(it)
+
+	// a new downloader replays the items of the previous one
+	restarted := setupDummyDownloader()
+	restarted.Journal = d.Journal
+	client := &http.Client{}
+	replayed, err := restarted.Replay(func(req *http.Request) *http.Client {
+		return client
+	})
+	replay, _ := restarted.Pop(false)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 1, replayed)
+	assert.Equal(t, myfile, replay.FilePath)
+	assert.Equal(t, "https://null.null/myfile", replay.Req.URL.String())
+	assert.Equal(t, "Basic dXNlcjpwYXNz", replay.Req.Header.Get("Authorization"))
+	assert.Equal(t, 2, replay.Attempts)
+	assert.Equal(t, `"v1"`, replay.Validator)
+	assert.Equal(t, client, replay.Client)
+
+	// completed items leave the journal
+	restarted.finish(replay, nil)
+	entries, _ := d.Journal.Load()
+	assert.Equal(t, 0, len(entries))
+}
+
+func TestJournalLoadInvalid(t *testing.T) {
+
+	j := &Journal{Dir: t.TempDir(), Logger: setupDummyDownloader().Logger}
+	ioutil.WriteFile(filepath.Join(j.Dir, "myinvalid.json"), []byte("{"), 0600)
+	ioutil.WriteFile(filepath.Join(j.Dir, "myleftover.json.tmp"), []byte("{}"), 0600)
+
+	entries, err := j.Load()
+	files, _ := ioutil.ReadDir(j.Dir)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(entries))
+	assert.Equal(t, 0, len(files))
+}
@@ -0,0 +1,219 @@
+package downloader
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ish-xyz/dcache/pkg/node/metadata"
+)
+
+// Tee caches a response body into the data dir while it's being read by someone else,
+// the item is moved in place only once the whole body has been read.
+// Other readers can follow the download while it's in progress, see NewReader()
+type Tee struct {
+	Body     io.ReadCloser
+	File     *os.File
+	FilePath string
+	Size     int64       // expected size, -1 if unknown
+	Digest   string      // expected sha256 digest, empty if unknown
+	URL      string      // source of the content, stored in the item metadata
+	Header   http.Header // response headers, stored in the item metadata
+	Private  bool        // fetched with the client credentials
+	hash     hash.Hash
+	mu       sync.Mutex
+	cond     *sync.Cond
+	written  int64 // bytes written into the temporary file
+	err      error // first error while caching, the body is still served
+	done     bool
+	d        *Downloader
+}
+
+// Reads a Tee while it's being written
+type followReader struct {
+	tee    *Tee
+	file   *os.File
+	offset int64
+}
+
+// Temporary files are hidden so that they're not notified to the scheduler,
+// they live in the same dir of the item so the final rename is atomic
+func tmpPath(filePath string) string {
+	return filepath.Join(filepath.Dir(filePath), fmt.Sprintf(".%s.tmp", filepath.Base(filePath)))
+}
+
+// Wrap body so that it gets written into filePath while being read
+func (d *Downloader) Tee(body io.ReadCloser, filePath string, size int64, digest string) (*Tee, error) {
+
+	file, err := os.Create(tmpPath(filePath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new empty temporary file: %v", err)
+	}
+
+	t := &Tee{
+		Body:     body,
+		File:     file,
+		FilePath: filePath,
+		Size:     size,
+		Digest:   digest,
+		hash:     sha256.New(),
+		d:        d,
+	}
+	t.cond = sync.NewCond(&t.mu)
+	return t, nil
+}
+
+func (t *Tee) Read(p []byte) (int, error) {
+
+	n, err := t.Body.Read(p)
+
+	t.mu.Lock()
+	if n > 0 && t.err == nil {
+		if _, werr := t.File.Write(p[:n]); werr != nil {
+			t.err = fmt.Errorf("failed to write into temporary file: %v", werr)
+		} else {
+			t.hash.Write(p[:n])
+			t.written += int64(n)
+		}
+	}
+	if err == io.EOF && !t.done {
+		t.finalize()
+	}
+	t.cond.Broadcast()
+	t.mu.Unlock()
+
+	return n, err
+}
+
+// Close the body, if it hasn't been fully read the temporary file is discarded
+func (t *Tee) Close() error {
+	t.mu.Lock()
+	if !t.done {
+		t.discard(fmt.Errorf("body closed before EOF"))
+		t.cond.Broadcast()
+	}
+	t.mu.Unlock()
+	return t.Body.Close()
+}
+
+// Completed returns true if the item has been moved in place
+func (t *Tee) Completed() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.done && t.err == nil
+}
+
+// Return a reader of the cached content starting at offset,
+// that follows the download until completion
+func (t *Tee) NewReader(offset int64) (io.ReadCloser, error) {
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.err != nil {
+		return nil, t.err
+	}
+
+	// once done the temporary file has been renamed
+	path := t.File.Name()
+	if t.done {
+		path = t.FilePath
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &followReader{tee: t, file: file, offset: offset}, nil
+}
+
+func (fr *followReader) Read(p []byte) (int, error) {
+
+	t := fr.tee
+
+	t.mu.Lock()
+	for fr.offset >= t.written && !t.done && t.err == nil {
+		t.cond.Wait()
+	}
+	written, err := t.written, t.err
+	t.mu.Unlock()
+
+	if err != nil {
+		return 0, err
+	}
+	if fr.offset >= written {
+		return 0, io.EOF
+	}
+
+	if available := written - fr.offset; int64(len(p)) > available {
+		p = p[:available]
+	}
+	n, err := fr.file.ReadAt(p, fr.offset)
+	fr.offset += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (fr *followReader) Close() error {
+	return fr.file.Close()
+}
+
+// the caller must hold t.mu
+func (t *Tee) finalize() {
+
+	t.done = true
+
+	if t.err == nil && t.Size >= 0 && t.written != t.Size {
+		t.err = fmt.Errorf("size mismatch, wanted %d actual %d", t.Size, t.written)
+	}
+
+	digest := fmt.Sprintf("%x", t.hash.Sum(nil))
+	if t.err == nil && t.Digest != "" && digest != t.Digest {
+		t.err = fmt.Errorf("digest mismatch, wanted %s actual %s", t.Digest, digest)
+	}
+
+	if err := t.File.Close(); err != nil && t.err == nil {
+		t.err = fmt.Errorf("failed to close temporary file: %v", err)
+	}
+
+	if t.err == nil {
+		if err := os.Rename(t.File.Name(), t.FilePath); err != nil {
+			t.err = fmt.Errorf("failed to rename temporary file: %v", err)
+		}
+	}
+
+	if t.err != nil {
+		t.d.Logger.Errorf("failed to cache item %s: %v", t.FilePath, t.err)
+		os.Remove(t.File.Name())
+		return
+	}
+	err := t.d.Metadata.Write(&metadata.Metadata{
+		Item:    filepath.Base(t.FilePath),
+		URL:     t.URL,
+		Size:    t.written,
+		Digest:  digest,
+		Header:  metadata.FilterHeader(t.Header),
+		Private: t.Private,
+	})
+	if err != nil {
+		t.d.Logger.Warnln(err)
+	}
+	t.d.Logger.Infof("cached item %s (%d bytes)", t.FilePath, t.written)
+}
+
+// the caller must hold t.mu
+func (t *Tee) discard(reason error) {
+	t.done = true
+	if t.err == nil {
+		t.err = reason
+	}
+	t.File.Close()
+	os.Remove(t.File.Name())
+	t.d.Logger.Debugf("discarded item %s: %v", t.FilePath, t.err)
+}
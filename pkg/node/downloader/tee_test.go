@@ -0,0 +1,138 @@
+package downloader
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTeeOK(t *testing.T) {
+
+	d := setupDummyDownloader()
+	myfile := fmt.Sprintf("%s/mytee.test", downloaderTestsDir)
+	body := ioutil.NopCloser(strings.NewReader("some content"))
+
+	tee, teeErr := d.Tee(body, myfile, 12, "")
+	served, readErr := ioutil.ReadAll(tee)
+	tee.Close()
+	cached, cachedErr := ioutil.ReadFile(myfile)
+	_, tmpErr := os.Stat(tmpPath(myfile))
+	md, mdFound := d.Metadata.Get("mytee.test")
+
+	assert.Nil(t, teeErr)
+	assert.Nil(t, readErr)
+	assert.Equal(t, "some content", string(served))
+	assert.True(t, tee.Completed())
+	assert.Nil(t, cachedErr)
+	assert.Equal(t, "some content", string(cached))
+	assert.NotNil(t, tmpErr)
+	assert.True(t, mdFound)
+	assert.Equal(t, int64(12), md.Size)
+
+	os.Remove(myfile)
+	d.Metadata.Delete("mytee.test")
+}
+
+func TestTeeClosedBeforeEOF(t *testing.T) {
+
+	d := setupDummyDownloader()
+	myfile := fmt.Sprintf("%s/mytee.test", downloaderTestsDir)
+	body := ioutil.NopCloser(strings.NewReader("some content"))
+
+	tee, _ := d.Tee(body, myfile, 12, "")
+	io.ReadFull(tee, make([]byte, 4))
+	tee.Close()
+	_, statErr := os.Stat(myfile)
+	_, tmpErr := os.Stat(tmpPath(myfile))
+
+	assert.False(t, tee.Completed())
+	assert.NotNil(t, statErr)
+	assert.NotNil(t, tmpErr)
+}
+
+func TestTeeSizeMismatch(t *testing.T) {
+
+	d := setupDummyDownloader()
+	myfile := fmt.Sprintf("%s/mytee.test", downloaderTestsDir)
+	body := ioutil.NopCloser(strings.NewReader("some content"))
+
+	tee, _ := d.Tee(body, myfile, 100, "")
+	served, _ := ioutil.ReadAll(tee)
+	tee.Close()
+	_, statErr := os.Stat(myfile)
+
+	assert.Equal(t, "some content", string(served))
+	assert.False(t, tee.Completed())
+	assert.NotNil(t, statErr)
+}
+
+func TestTeeFollowReader(t *testing.T) {
+
+	d := setupDummyDownloader()
+	myfile := fmt.Sprintf("%s/myfollow.test", downloaderTestsDir)
+	pr, pw := io.Pipe()
+
+	tee, _ := d.Tee(pr, myfile, 12, "")
+	reader, readerErr := tee.NewReader(0)
+
+	followed := make(chan string)
+	go func() {
+		data, _ := ioutil.ReadAll(reader)
+		followed <- string(data)
+	}()
+	go func() {
+		pw.Write([]byte("some "))
+		pw.Write([]byte("content"))
+		pw.Close()
+	}()
+	served, _ := ioutil.ReadAll(tee)
+	tee.Close()
+
+	assert.Nil(t, readerErr)
+	assert.Equal(t, "some content", string(served))
+	assert.Equal(t, "some content", <-followed)
+	assert.True(t, tee.Completed())
+
+	reader.Close()
+	os.Remove(myfile)
+}
+
+func TestTeeFollowReaderOffset(t *testing.T) {
+
+	d := setupDummyDownloader()
+	myfile := fmt.Sprintf("%s/myfollow.test", downloaderTestsDir)
+	body := ioutil.NopCloser(strings.NewReader("some content"))
+
+	tee, _ := d.Tee(body, myfile, 12, "")
+	reader, readerErr := tee.NewReader(5)
+	ioutil.ReadAll(tee)
+	tee.Close()
+	followed, _ := ioutil.ReadAll(reader)
+
+	assert.Nil(t, readerErr)
+	assert.Equal(t, "content", string(followed))
+
+	reader.Close()
+	os.Remove(myfile)
+}
+
+func TestTeeDigestMismatch(t *testing.T) {
+
+	d := setupDummyDownloader()
+	myfile := fmt.Sprintf("%s/mytee.test", downloaderTestsDir)
+	body := ioutil.NopCloser(strings.NewReader("some content"))
+
+	tee, _ := d.Tee(body, myfile, 12, strings.Repeat("0", 64))
+	served, _ := ioutil.ReadAll(tee)
+	tee.Close()
+	_, statErr := os.Stat(myfile)
+
+	assert.Equal(t, "some content", string(served))
+	assert.False(t, tee.Completed())
+	assert.NotNil(t, statErr)
+}
@@ -0,0 +1,216 @@
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const sidecarExt = ".json"
+
+// Headers of the original response that are replayed when serving an item
+var CachedHeaders = []string{
+	"Content-Type",
+	"Cache-Control",
+	"Etag",
+	"Last-Modified",
+	"Docker-Content-Digest",
+}
+
+type Metadata struct {
+	Item      string      `json:"item"`
+	URL       string      `json:"url,omitempty"`
+	Size      int64       `json:"size"`
+	Digest    string      `json:"digest,omitempty"` // sha256 of the content, empty if not computed yet
+	Header    http.Header `json:"header,omitempty"`
+	Private   bool        `json:"private,omitempty"` // fetched with the client credentials, never served without authorization
+	CreatedAt int64       `json:"createdAt"`
+}
+
+// Metadata of the items in the data dir, each item has
+// a json sidecar file in <dataDir>/.meta, hidden to the notifier
+type Store struct {
+	DataDir string        `validate:"required"`
+	Dir     string        `validate:"required"`
+	Logger  *logrus.Entry `validate:"required"`
+	mu      sync.RWMutex
+	items   map[string]*Metadata
+}
+
+func NewStore(dataDir string, log *logrus.Entry) *Store {
+	return &Store{
+		DataDir: dataDir,
+		Dir:     filepath.Join(dataDir, ".meta"),
+		Logger:  log,
+		items:   make(map[string]*Metadata),
+	}
+}
+
+// Return the subset of header that is stored with the item
+func FilterHeader(header http.Header) http.Header {
+	filtered := make(http.Header)
+	for _, key := range CachedHeaders {
+		if v := header.Get(key); v != "" {
+			filtered.Set(key, v)
+		}
+	}
+	return filtered
+}
+
+func (s *Store) sidecarPath(item string) string {
+	return filepath.Join(s.Dir, item+sidecarExt)
+}
+
+// Write the metadata of an item, replacing the previous one
+func (s *Store) Write(md *Metadata) error {
+
+	if md.CreatedAt == 0 {
+		md.CreatedAt = time.Now().Unix()
+	}
+
+	data, err := json.Marshal(md)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(s.Dir, 0755)
+	if err != nil {
+		return fmt.Errorf("failed to create metadata dir: %v", err)
+	}
+
+	// rename is atomic, a crash never leaves a truncated sidecar
+	tmp := s.sidecarPath(md.Item) + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write metadata of %s: %v", md.Item, err)
+	}
+	err = os.Rename(tmp, s.sidecarPath(md.Item))
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write metadata of %s: %v", md.Item, err)
+	}
+
+	s.mu.Lock()
+	s.items[md.Item] = md
+	s.mu.Unlock()
+	return nil
+}
+
+// Return a copy of the metadata of an item
+func (s *Store) Get(item string) (*Metadata, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	md, ok := s.items[item]
+	if !ok {
+		return nil, false
+	}
+	cp := *md
+	return &cp, true
+}
+
+func (s *Store) Delete(item string) error {
+	s.mu.Lock()
+	delete(s.items, item)
+	s.mu.Unlock()
+
+	err := os.Remove(s.sidecarPath(item))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Return the metadata of all items, sorted by item name
+func (s *Store) List() []*Metadata {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	list := make([]*Metadata, 0, len(s.items))
+	for _, md := range s.items {
+		cp := *md
+		list = append(list, &cp)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Item < list[j].Item
+	})
+	return list
+}
+
+// Load the metadata of the items in the data dir, sidecars of deleted items are removed
+// and items without a sidecar (e.g.: cached by an older version) get a minimal one
+func (s *Store) Rebuild() error {
+
+	files, err := ioutil.ReadDir(s.DataDir)
+	if err != nil {
+		return fmt.Errorf("error while reading dataDir: %v", err)
+	}
+
+	items := make(map[string]os.FileInfo)
+	for _, fi := range files {
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		items[fi.Name()] = fi
+	}
+
+	loaded := make(map[string]*Metadata)
+	sidecars, err := ioutil.ReadDir(s.Dir)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error while reading metadata dir: %v", err)
+	}
+	for _, fi := range sidecars {
+		sidecar := filepath.Join(s.Dir, fi.Name())
+		item := strings.TrimSuffix(fi.Name(), sidecarExt)
+		itemInfo, exists := items[item]
+		if !strings.HasSuffix(fi.Name(), sidecarExt) || !exists {
+			s.Logger.Debugln("removing stale metadata file", sidecar)
+			os.Remove(sidecar)
+			continue
+		}
+
+		md := &Metadata{}
+		data, err := ioutil.ReadFile(sidecar)
+		if err == nil {
+			err = json.Unmarshal(data, md)
+		}
+		if err != nil || md.Item != item || md.Size != itemInfo.Size() {
+			s.Logger.Warnf("invalid metadata for item %s, discarding it", item)
+			os.Remove(sidecar)
+			continue
+		}
+		loaded[item] = md
+	}
+
+	s.mu.Lock()
+	s.items = loaded
+	s.mu.Unlock()
+
+	for item, fi := range items {
+		if _, ok := loaded[item]; ok {
+			continue
+		}
+		// the origin of the item is unknown, it can't be assumed to be public
+		err := s.Write(&Metadata{
+			Item:      item,
+			Size:      fi.Size(),
+			Private:   true,
+			CreatedAt: fi.ModTime().Unix(),
+		})
+		if err != nil {
+			s.Logger.Errorln(err)
+		}
+	}
+
+	s.Logger.Infof("loaded metadata of %d items", len(items))
+	return nil
+}
@@ -0,0 +1,86 @@
+package metadata
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupStore(t *testing.T) *Store {
+	return NewStore(t.TempDir(), logrus.NewEntry(logrus.New()))
+}
+
+func TestWriteGetDelete(t *testing.T) {
+	s := setupStore(t)
+	md := &Metadata{
+		Item:   "item1",
+		URL:    "http://upstream/file.zip",
+		Size:   12,
+		Header: http.Header{"Content-Type": []string{"application/zip"}},
+	}
+
+	writeErr := s.Write(md)
+	read, found := s.Get("item1")
+	_, sidecarErr := os.Stat(s.sidecarPath("item1"))
+	deleteErr := s.Delete("item1")
+	_, deleted := s.Get("item1")
+	missingErr := s.Delete("item1")
+
+	assert.Nil(t, writeErr)
+	assert.True(t, found)
+	assert.Equal(t, "application/zip", read.Header.Get("Content-Type"))
+	assert.NotZero(t, read.CreatedAt)
+	assert.Nil(t, sidecarErr)
+	assert.Nil(t, deleteErr)
+	assert.False(t, deleted)
+	assert.Nil(t, missingErr)
+}
+
+func TestFilterHeader(t *testing.T) {
+	header := http.Header{
+		"Content-Type":          []string{"application/octet-stream"},
+		"Docker-Content-Digest": []string{"sha256:abc"},
+		"Set-Cookie":            []string{"session=secret"},
+	}
+
+	filtered := FilterHeader(header)
+
+	assert.Equal(t, http.Header{
+		"Content-Type":          []string{"application/octet-stream"},
+		"Docker-Content-Digest": []string{"sha256:abc"},
+	}, filtered)
+}
+
+func TestRebuild(t *testing.T) {
+	s := setupStore(t)
+	ioutil.WriteFile(fmt.Sprintf("%s/item1", s.DataDir), []byte("content"), 0644)
+	ioutil.WriteFile(fmt.Sprintf("%s/item2", s.DataDir), []byte("content"), 0644)
+	ioutil.WriteFile(fmt.Sprintf("%s/item3", s.DataDir), []byte("content"), 0644)
+	ioutil.WriteFile(fmt.Sprintf("%s/.item4.tmp", s.DataDir), []byte("partial"), 0644)
+	s.Write(&Metadata{Item: "item1", URL: "http://upstream/item1", Size: 7})
+	s.Write(&Metadata{Item: "item2", URL: "http://upstream/item2", Size: 100})
+	s.Write(&Metadata{Item: "deleted", Size: 7})
+
+	restarted := NewStore(s.DataDir, s.Logger)
+	err := restarted.Rebuild()
+	item1, _ := restarted.Get("item1")
+	item2, _ := restarted.Get("item2")
+	item3, _ := restarted.Get("item3")
+	_, deletedFound := restarted.Get("deleted")
+	_, deletedSidecarErr := os.Stat(s.sidecarPath("deleted"))
+
+	assert.Nil(t, err)
+	assert.Len(t, restarted.List(), 3)
+	assert.Equal(t, "http://upstream/item1", item1.URL)
+	// size doesn't match, the metadata is discarded and rebuilt
+	assert.Equal(t, "", item2.URL)
+	assert.Equal(t, int64(7), item2.Size)
+	assert.Equal(t, int64(7), item3.Size)
+	assert.False(t, deletedFound)
+	assert.NotNil(t, deletedSidecarErr)
+}
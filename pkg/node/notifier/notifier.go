@@ -2,6 +2,7 @@ package notifier
 
 import (
 	"path/filepath"
+	"strings"
 	"sync"
 
 	"github.com/fsnotify/fsnotify"
@@ -72,6 +73,10 @@ func (nt *Notifier) Run(once bool) error {
 				}
 
 				item := filepath.Base(event.Name)
+				if strings.HasPrefix(item, ".") {
+					// hidden files are temporary files or metadata, not items
+					continue
+				}
 				ntEvent := &Event{
 					Item: item,
 					Op:   int(event.Op),
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Max entries before expired authorization checks are swept
+const authCacheSweepSize = 1024
+
+// Docker registry v2 paths, authorization is granted per repository
+var repositoryRegex = regexp.MustCompile(`^/v2/(.+?)/(blobs|manifests|tags)/`)
+
+// Successful authorization checks, keyed by upstream, credential and repository
+type authCache struct {
+	mu      sync.Mutex
+	entries map[string]time.Time // expiration
+}
+
+func newAuthCache() *authCache {
+	return &authCache{
+		entries: make(map[string]time.Time),
+	}
+}
+
+// Credentials are hashed, so that they're not kept in memory
+func authKey(up *UpstreamConfig, r *http.Request) string {
+	id := fmt.Sprintf("%s\n%s\n%s", up.Name, r.Header.Get("Authorization"), authScope(up, r))
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(id)))
+}
+
+// Repository of registry requests, the whole path otherwise
+func authScope(up *UpstreamConfig, r *http.Request) string {
+	path := strings.TrimPrefix(r.URL.Path, up.Prefix)
+	if match := repositoryRegex.FindStringSubmatch(path); match != nil {
+		return match[1]
+	}
+	return path
+}
+
+func (ac *authCache) valid(key string) bool {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	expiration, ok := ac.entries[key]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expiration) {
+		delete(ac.entries, key)
+		return false
+	}
+	return true
+}
+
+func (ac *authCache) add(key string, ttl time.Duration) {
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+
+	now := time.Now()
+	if len(ac.entries) >= authCacheSweepSize {
+		for k, expiration := range ac.entries {
+			if now.After(expiration) {
+				delete(ac.entries, k)
+			}
+		}
+	}
+	ac.entries[key] = now.Add(ttl)
+}
+
+// Items fetched with credentials, or whose origin is unknown, are private
+func (no *Node) isPrivate(item string) bool {
+	md, ok := no.Downloader.Metadata.Get(item)
+	return !ok || md.Private
+}
+
+// Record a successful authorization check done by someone else (e.g.: the HEAD check)
+func (no *Node) authorized(r *http.Request, up *UpstreamConfig) {
+	if up.AuthTTL > 0 {
+		no.auth.add(authKey(up, r), up.AuthTTL)
+	}
+}
+
+// Validate the credentials of the client with a HEAD request to the upstream,
+// successful checks are cached for AuthTTL. Failed checks are never cached
+func (no *Node) checkAuth(r *http.Request, up *UpstreamConfig, url, host string) error {
+
+	if no.auth.valid(authKey(up, r)) {
+		return nil
+	}
+
+	headReq, err := copyRequest(r.Context(), r, url, host, http.MethodHead)
+	if err != nil {
+		return err
+	}
+	up.setHeaders(headReq)
+
+	_, err = runRequestCheck(up.client, headReq)
+	if err != nil {
+		return err
+	}
+
+	no.authorized(r, up)
+	return nil
+}
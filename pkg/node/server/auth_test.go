@@ -0,0 +1,120 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ish-xyz/dcache/pkg/node/metadata"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupAuthUpstream(t *testing.T, heads *int32) *UpstreamConfig {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			atomic.AddInt32(heads, 1)
+		}
+		if r.Header.Get("Authorization") != "Bearer valid" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Etag", "abc")
+	}))
+	t.Cleanup(srv.Close)
+
+	up := &UpstreamConfig{
+		Name:        "registry",
+		Prefix:      "/registry",
+		Address:     srv.URL,
+		Regex:       regexp.MustCompile(".*"),
+		KeyStrategy: KeyETag,
+		MaxFailures: 3,
+		Cooldown:    time.Minute,
+		Immutable:   regexp.MustCompile(`/blobs/sha256:([a-f0-9]+)`),
+		AuthCheck:   true,
+		AuthTTL:     time.Minute,
+	}
+	if err := up.init(logrus.NewEntry(logrus.New())); err != nil {
+		t.Fatal(err)
+	}
+	return up
+}
+
+func TestAuthCacheExpiration(t *testing.T) {
+	ac := newAuthCache()
+
+	ac.add("valid", time.Minute)
+	ac.add("expired", -time.Second)
+
+	assert.True(t, ac.valid("valid"))
+	assert.False(t, ac.valid("expired"))
+	assert.False(t, ac.valid("missing"))
+}
+
+func TestResolveImmutableItem(t *testing.T) {
+	var heads int32
+	no := setupTestNode(t)
+	up := setupAuthUpstream(t, &heads)
+	path := "/v2/alpine/blobs/sha256:" + strings.Repeat("a", 64)
+	url := up.Address + path
+	host := strings.TrimPrefix(up.Address, "http://")
+
+	first := httptest.NewRequest(http.MethodGet, "/registry"+path, nil)
+	first.Header.Set("Authorization", "Bearer valid")
+	firstItem, firstOk := no.resolveItem(httptest.NewRecorder(), first, up, up.proxy, url, host)
+	second := httptest.NewRequest(http.MethodGet, "/registry"+path, nil)
+	second.Header.Set("Authorization", "Bearer valid")
+	_, secondOk := no.resolveItem(httptest.NewRecorder(), second, up, up.proxy, url, host)
+
+	unauthorized := httptest.NewRequest(http.MethodGet, "/registry"+path, nil)
+	unauthorized.Header.Set("Authorization", "Bearer invalid")
+	denied := httptest.NewRecorder()
+	_, unauthorizedOk := no.resolveItem(denied, unauthorized, up, up.proxy, url, host)
+
+	assert.True(t, firstOk)
+	assert.Equal(t, up.itemName(digestHash(strings.Repeat("a", 64))), firstItem)
+	assert.True(t, secondOk)
+	assert.False(t, unauthorizedOk)
+	assert.Equal(t, http.StatusUnauthorized, denied.Code)
+	// one successful check for the valid credential, one failed for the invalid one
+	assert.Equal(t, int32(2), atomic.LoadInt32(&heads))
+}
+
+func TestResolveImmutableItemWithoutAuthCheck(t *testing.T) {
+	var heads int32
+	no := setupTestNode(t)
+	up := setupAuthUpstream(t, &heads)
+	up.AuthCheck = false
+	publicPath := "/v2/alpine/blobs/sha256:" + strings.Repeat("a", 64)
+	privatePath := "/v2/private/blobs/sha256:" + strings.Repeat("b", 64)
+	no.Downloader.Metadata.Write(&metadata.Metadata{Item: up.itemName(digestHash(strings.Repeat("a", 64)))})
+	no.Downloader.Metadata.Write(&metadata.Metadata{Item: up.itemName(digestHash(strings.Repeat("b", 64))), Private: true})
+
+	public := httptest.NewRequest(http.MethodGet, "/registry"+publicPath, nil)
+	_, publicOk := no.resolveItem(httptest.NewRecorder(), public, up, up.proxy, up.Address+publicPath, "")
+	publicHeads := atomic.LoadInt32(&heads)
+	private := httptest.NewRequest(http.MethodGet, "/registry"+privatePath, nil)
+	_, privateOk := no.resolveItem(httptest.NewRecorder(), private, up, up.proxy, up.Address+privatePath, "")
+
+	assert.True(t, publicOk)
+	assert.Equal(t, int32(0), publicHeads)
+	assert.False(t, privateOk)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&heads))
+}
+
+func TestAuthScope(t *testing.T) {
+	up := &UpstreamConfig{Prefix: "/registry"}
+	blob := httptest.NewRequest(http.MethodGet, "/registry/v2/library/alpine/blobs/sha256:abc", nil)
+	manifest := httptest.NewRequest(http.MethodGet, "/registry/v2/library/alpine/manifests/latest", nil)
+	file := httptest.NewRequest(http.MethodGet, "/registry/files/archive.zip", nil)
+
+	assert.Equal(t, "library/alpine", authScope(up, blob))
+	assert.Equal(t, "library/alpine", authScope(up, manifest))
+	assert.Equal(t, "/files/archive.zip", authScope(up, file))
+	assert.Equal(t, authKey(up, blob), authKey(up, manifest))
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Used when the token server doesn't say how long the token is valid
+const defaultTokenTTL = 60 * time.Second
+
+var challengeParamRegex = regexp.MustCompile(`(\w+)="([^"]*)"`)
+
+// Answers the bearer challenges of the upstream (Docker registry token flow) on behalf of the
+// clients that don't send credentials, using the upstream credentials if configured.
+// Requests that carry credentials are left to the client
+type bearerTransport struct {
+	Transport      http.RoundTripper // to the upstream
+	TokenTransport http.RoundTripper // to the token server
+	Username       string
+	Password       string
+	mu             sync.Mutex
+	challenges     map[string]*challenge // last challenge, keyed by host and repository
+	tokens         map[string]bearerToken
+}
+
+type challenge struct {
+	Realm   string
+	Service string
+	Scope   string
+}
+
+type bearerToken struct {
+	Token      string
+	Expiration time.Time
+}
+
+func newBearerTransport(transport, tokenTransport http.RoundTripper, username, password string) *bearerTransport {
+	return &bearerTransport{
+		Transport:      transport,
+		TokenTransport: tokenTransport,
+		Username:       username,
+		Password:       password,
+		challenges:     make(map[string]*challenge),
+		tokens:         make(map[string]bearerToken),
+	}
+}
+
+// Parse a WWW-Authenticate header, nil if it's not a bearer challenge
+func parseChallenge(header string) *challenge {
+
+	if !strings.HasPrefix(strings.ToLower(header), "bearer ") {
+		return nil
+	}
+
+	c := &challenge{}
+	for _, match := range challengeParamRegex.FindAllStringSubmatch(header, -1) {
+		switch strings.ToLower(match[1]) {
+		case "realm":
+			c.Realm = match[2]
+		case "service":
+			c.Service = match[2]
+		case "scope":
+			c.Scope = match[2]
+		}
+	}
+	if c.Realm == "" {
+		return nil
+	}
+	return c
+}
+
+func (c *challenge) key() string {
+	return fmt.Sprintf("%s\n%s\n%s", c.Realm, c.Service, c.Scope)
+}
+
+func challengeKey(req *http.Request) string {
+	scope := req.URL.Path
+	if match := repositoryRegex.FindStringSubmatch(req.URL.Path); match != nil {
+		scope = match[1]
+	}
+	return fmt.Sprintf("%s %s", req.URL.Host, scope)
+}
+
+func (bt *bearerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	if req.Header.Get("Authorization") != "" {
+		return bt.Transport.RoundTrip(req)
+	}
+
+	// a request with a body can be sent only once, unless it can be replayed
+	replayable := req.Body == nil || req.Body == http.NoBody || req.GetBody != nil
+
+	// skip the challenge if the repository has already been challenged
+	key := challengeKey(req)
+	if token, ok := bt.cachedToken(key); ok && replayable {
+		resp, err := bt.Transport.RoundTrip(withToken(req, token))
+		if err != nil || resp.StatusCode != http.StatusUnauthorized {
+			return restoreRequest(resp, req), err
+		}
+		resp.Body.Close()
+	}
+
+	resp, err := bt.Transport.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized || !replayable {
+		return resp, err
+	}
+
+	c := parseChallenge(resp.Header.Get("Www-Authenticate"))
+	if c == nil {
+		return resp, nil
+	}
+
+	token, err := bt.fetchToken(req.Context(), c)
+	if err != nil {
+		// the client gets the challenge, it might be able to answer it
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	bt.mu.Lock()
+	bt.challenges[key] = c
+	bt.mu.Unlock()
+
+	retry := withToken(req, token)
+	if req.GetBody != nil {
+		retry.Body, err = req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+	}
+	resp, err = bt.Transport.RoundTrip(retry)
+	return restoreRequest(resp, req), err
+}
+
+func (bt *bearerTransport) cachedToken(key string) (string, bool) {
+	bt.mu.Lock()
+	defer bt.mu.Unlock()
+
+	c, ok := bt.challenges[key]
+	if !ok {
+		return "", false
+	}
+	token, ok := bt.tokens[c.key()]
+	if !ok || time.Now().After(token.Expiration) {
+		return "", false
+	}
+	return token.Token, true
+}
+
+// Ask the token server for a token that answers the challenge
+func (bt *bearerTransport) fetchToken(ctx context.Context, c *challenge) (string, error) {
+
+	bt.mu.Lock()
+	token, ok := bt.tokens[c.key()]
+	bt.mu.Unlock()
+	if ok && time.Now().Before(token.Expiration) {
+		return token.Token, nil
+	}
+
+	u, err := url.Parse(c.Realm)
+	if err != nil {
+		return "", err
+	}
+	query := u.Query()
+	if c.Service != "" {
+		query.Set("service", c.Service)
+	}
+	if c.Scope != "" {
+		query.Set("scope", c.Scope)
+	}
+	u.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if bt.Username != "" {
+		req.SetBasicAuth(bt.Username, bt.Password)
+	}
+
+	resp, err := bt.TokenTransport.RoundTrip(req)
+	if err != nil {
+		return "", fmt.Errorf("token request error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token server returned status code %d", resp.StatusCode)
+	}
+
+	var tokenResp struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&tokenResp)
+	if err != nil {
+		return "", fmt.Errorf("invalid token response: %v", err)
+	}
+
+	token.Token = tokenResp.Token
+	if token.Token == "" {
+		token.Token = tokenResp.AccessToken
+	}
+	if token.Token == "" {
+		return "", fmt.Errorf("token server returned no token")
+	}
+
+	ttl := defaultTokenTTL
+	if tokenResp.ExpiresIn > 0 {
+		ttl = time.Duration(tokenResp.ExpiresIn) * time.Second
+	}
+	// leave some margin for the requests in flight
+	token.Expiration = time.Now().Add(ttl * 9 / 10)
+
+	bt.mu.Lock()
+	bt.tokens[c.key()] = token
+	bt.mu.Unlock()
+	return token.Token, nil
+}
+
+func withToken(req *http.Request, token string) *http.Request {
+	out := req.Clone(req.Context())
+	out.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	return out
+}
+
+// The token is added by the node, the response belongs to the original request
+func restoreRequest(resp *http.Response, req *http.Request) *http.Response {
+	if resp != nil {
+		resp.Request = req
+	}
+	return resp
+}
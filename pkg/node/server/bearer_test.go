@@ -0,0 +1,94 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setupRegistry(t *testing.T, tokenRequests *int32) *httptest.Server {
+
+	tokenSrv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(tokenRequests, 1)
+		user, pass, _ := r.BasicAuth()
+		if user != "robot" || pass != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprintf(w, `{"token": "token-%s", "expires_in": 300}`, r.URL.Query().Get("scope"))
+	}))
+	t.Cleanup(tokenSrv.Close)
+
+	registry := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scope := "repository:library/alpine:pull"
+		if r.Header.Get("Authorization") != "Bearer token-"+scope {
+			w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registry",scope="%s"`, tokenSrv.URL, scope))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("layer"))
+	}))
+	t.Cleanup(registry.Close)
+	return registry
+}
+
+func TestParseChallenge(t *testing.T) {
+	c := parseChallenge(`Bearer realm="https://auth.docker.io/token",service="registry.docker.io",scope="repository:library/alpine:pull"`)
+
+	assert.Equal(t, &challenge{
+		Realm:   "https://auth.docker.io/token",
+		Service: "registry.docker.io",
+		Scope:   "repository:library/alpine:pull",
+	}, c)
+	assert.Nil(t, parseChallenge(`Basic realm="registry"`))
+	assert.Nil(t, parseChallenge(""))
+}
+
+func TestBearerTransport(t *testing.T) {
+	var tokenRequests int32
+	registry := setupRegistry(t, &tokenRequests)
+	client := &http.Client{Transport: newBearerTransport(http.DefaultTransport, http.DefaultTransport, "robot", "secret")}
+	blob := registry.URL + "/v2/library/alpine/blobs/sha256:abc"
+
+	first, firstErr := client.Get(blob)
+	second, secondErr := client.Get(blob)
+
+	assert.Nil(t, firstErr)
+	assert.Equal(t, http.StatusOK, first.StatusCode)
+	assert.Equal(t, "", first.Request.Header.Get("Authorization"))
+	assert.Nil(t, secondErr)
+	assert.Equal(t, http.StatusOK, second.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(&tokenRequests))
+}
+
+func TestBearerTransportClientCredentials(t *testing.T) {
+	var tokenRequests int32
+	registry := setupRegistry(t, &tokenRequests)
+	client := &http.Client{Transport: newBearerTransport(http.DefaultTransport, http.DefaultTransport, "robot", "secret")}
+	req, _ := http.NewRequest(http.MethodGet, registry.URL+"/v2/library/alpine/blobs/sha256:abc", nil)
+	req.Header.Set("Authorization", "Bearer client-token")
+
+	resp, err := client.Do(req)
+
+	// the client answers the challenge on its own
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Www-Authenticate"))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&tokenRequests))
+}
+
+func TestBearerTransportTokenDenied(t *testing.T) {
+	var tokenRequests int32
+	registry := setupRegistry(t, &tokenRequests)
+	client := &http.Client{Transport: newBearerTransport(http.DefaultTransport, http.DefaultTransport, "", "")}
+
+	resp, err := client.Get(registry.URL + "/v2/library/alpine/blobs/sha256:abc")
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	assert.NotEmpty(t, resp.Header.Get("Www-Authenticate"))
+}
@@ -0,0 +1,205 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/ish-xyz/dcache/pkg/node/downloader"
+	"github.com/ish-xyz/dcache/pkg/node/metadata"
+)
+
+type cacheTargetKey struct{}
+
+// Attached to the request context of cache misses,
+// tells the proxies where to cache the response body.
+// Concurrent misses of the same item share the same target
+type cacheTarget struct {
+	FilePath string
+	Tee      *downloader.Tee
+	Header   http.Header
+	ready    chan struct{} // closed once the response of the first request is known
+	once     sync.Once
+}
+
+// Cache misses in progress, keyed by item
+type inflightGroup struct {
+	mu      sync.Mutex
+	targets map[string]*cacheTarget
+}
+
+func newInflightGroup() *inflightGroup {
+	return &inflightGroup{
+		targets: make(map[string]*cacheTarget),
+	}
+}
+
+// Return the target for item, leader is true if the caller is the one that has to fetch it
+func (g *inflightGroup) join(item, filePath string) (target *cacheTarget, leader bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if target, ok := g.targets[item]; ok {
+		return target, false
+	}
+	target = &cacheTarget{
+		FilePath: filePath,
+		ready:    make(chan struct{}),
+	}
+	g.targets[item] = target
+	return target, true
+}
+
+// Return the target for item if there's a fetch in progress
+func (g *inflightGroup) get(item string) *cacheTarget {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.targets[item]
+}
+
+// Called by the leader once the fetch is over
+func (g *inflightGroup) leave(item string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if target, ok := g.targets[item]; ok {
+		target.release()
+		delete(g.targets, item)
+	}
+}
+
+// Wake up the requests waiting on this target
+func (t *cacheTarget) release() {
+	t.once.Do(func() {
+		close(t.ready)
+	})
+}
+
+// Check if the item is in the local cache, items whose content
+// doesn't match the digest in the url are removed
+func (no *Node) isCached(filePath string, u *url.URL) bool {
+
+	if _, err := os.Stat(filePath); err != nil {
+		return false
+	}
+
+	expected := downloader.ExpectedDigest(u)
+	if expected == "" {
+		return true
+	}
+
+	err := no.Downloader.Verify(filePath, expected)
+	if err != nil {
+		no.Logger.Errorf("refusing to serve corrupted item %s: %v", filePath, err)
+		if err := os.Remove(filePath); err != nil {
+			no.Logger.Errorf("failed to delete corrupted item %s: %v", filePath, err)
+		}
+		no.Downloader.Metadata.Delete(filepath.Base(filePath))
+		return false
+	}
+	return true
+}
+
+// ModifyResponse hook for the proxies: cache the response body while it gets streamed to the client
+func (no *Node) cacheResponse(resp *http.Response) error {
+
+	target, ok := resp.Request.Context().Value(cacheTargetKey{}).(*cacheTarget)
+	if !ok {
+		return nil
+	}
+	defer target.release()
+
+	if resp.StatusCode != http.StatusOK {
+		no.Logger.Debugf("not caching %s, status code is %d", target.FilePath, resp.StatusCode)
+		return nil
+	}
+
+	// the client might have negotiated an encoding, we only cache the original content
+	if enc := resp.Header.Get("Content-Encoding"); enc != "" && enc != "identity" {
+		no.Logger.Debugf("not caching %s, content is encoded with %s", target.FilePath, enc)
+		return nil
+	}
+
+	digest := downloader.ExpectedDigest(resp.Request.URL)
+	tee, err := no.Downloader.Tee(resp.Body, target.FilePath, resp.ContentLength, digest)
+	if err != nil {
+		no.Logger.Errorf("failed to cache item %s: %v", target.FilePath, err)
+		return nil
+	}
+	tee.URL = resp.Request.URL.String()
+	tee.Header = resp.Header.Clone()
+	tee.Private = resp.Request.Header.Get("Authorization") != ""
+	target.Header = tee.Header
+	target.Tee = tee
+	resp.Body = tee
+	return nil
+}
+
+// Stream an item that is being cached by another request,
+// returns false if it's not possible and the caller needs to fetch the item on its own
+func (no *Node) serveInflight(w http.ResponseWriter, r *http.Request, target *cacheTarget) bool {
+
+	select {
+	case <-target.ready:
+	case <-r.Context().Done():
+		return true
+	}
+
+	if target.Tee == nil {
+		return false
+	}
+
+	// serve ranges only if we know the size of the item
+	status := http.StatusOK
+	contentRange := ""
+	offset, length := int64(0), target.Tee.Size
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" && target.Tee.Size >= 0 {
+		start, n, err := parseRange(rangeHeader, target.Tee.Size)
+		if err == errRangeNotSatisfiable {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", target.Tee.Size))
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return true
+		}
+		if err == nil {
+			status = http.StatusPartialContent
+			offset, length = start, n
+			contentRange = fmt.Sprintf("bytes %d-%d/%d", start, start+n-1, target.Tee.Size)
+		}
+	}
+
+	reader, err := target.Tee.NewReader(offset)
+	if err != nil {
+		no.Logger.Debugf("can't follow download of %s: %v", target.FilePath, err)
+		return false
+	}
+	defer reader.Close()
+
+	no.Logger.Infoln("serving in-flight item", r.RequestURI)
+	for _, key := range metadata.CachedHeaders {
+		if v := target.Header.Get(key); v != "" {
+			w.Header().Set(key, v)
+		}
+	}
+	w.Header().Set("Accept-Ranges", "bytes")
+	if contentRange != "" {
+		w.Header().Set("Content-Range", contentRange)
+	}
+
+	var body io.Reader = reader
+	if length >= 0 {
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", length))
+		body = io.LimitReader(reader, length)
+	}
+	w.WriteHeader(status)
+
+	_, err = io.Copy(w, body)
+	if err != nil {
+		no.Logger.Warnf("failed to serve in-flight item %s: %v", target.FilePath, err)
+	}
+	return true
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+)
+
+// Number of nodes a request went through, set on the requests sent to peers
+const HopsHeader = "X-Dcache-Hops"
+
+type peerFallbackKey struct{}
+
+// Hops of a request, 0 if it comes from a client
+func requestHops(r *http.Request) int {
+	hops, err := strconv.Atoi(r.Header.Get(HopsHeader))
+	if err != nil || hops < 0 {
+		return 0
+	}
+	return hops
+}
+
+// Look for a peer that has the item, returns a copy of the request rewritten to the peer.
+// Requests that reached the max hops can't go through another peer
+func (no *Node) peerRequest(r *http.Request, item string) (*http.Request, bool) {
+
+	hops := requestHops(r)
+	if hops >= no.MaxHops {
+		no.Logger.Debugf("not looking for peers, request has already done %d hops", hops)
+		return nil, false
+	}
+
+	peerinfo, err := no.Client.GetPeers(item)
+	if err != nil {
+		no.Logger.Errorln("error looking for peer:", err)
+		return nil, false
+	}
+
+	peerReq := r.Clone(r.Context())
+	rewriteToPeer(peerReq, peerinfo)
+	peerReq.Header.Set(HopsHeader, strconv.Itoa(hops+1))
+	return peerReq, true
+}
+
+// Run the request through the peer proxy, fallback serves the request if the peer fails
+func withPeerFallback(peerReq *http.Request, fallback func(http.ResponseWriter)) *http.Request {
+	return peerReq.WithContext(context.WithValue(peerReq.Context(), peerFallbackKey{}, fallback))
+}
+
+// Requests from peers are served only from the local disk, or through another peer
+// if the max hops allow it. The peer that sent the request falls back to the upstream
+func (no *Node) forwardToPeer(w http.ResponseWriter, r *http.Request, item string, peerProxy *httputil.ReverseProxy) {
+
+	notFound := func(w http.ResponseWriter) {
+		http.Error(w, "item not cached", http.StatusNotFound)
+	}
+
+	peerReq, ok := no.peerRequest(r, item)
+	if !ok {
+		notFound(w)
+		return
+	}
+	no.runProxy(peerProxy, w, withPeerFallback(peerReq, notFound))
+}
+
+// ModifyResponse hook for the peer proxy: failed responses go to the fallback,
+// successful ones get cached
+func (no *Node) peerResponse(resp *http.Response) error {
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("peer returned status code %d", resp.StatusCode)
+	}
+	return no.cacheResponse(resp)
+}
+
+// ErrorHandler of the peer proxy
+func (no *Node) peerError(w http.ResponseWriter, r *http.Request, err error) {
+
+	fallback, ok := r.Context().Value(peerFallbackKey{}).(func(http.ResponseWriter))
+	if !ok {
+		no.Logger.Errorln("peer request failed:", err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	no.Logger.Warnln("peer request failed, falling back:", err)
+	fallback(w)
+}
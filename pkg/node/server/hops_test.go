@@ -0,0 +1,124 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/ish-xyz/dcache/pkg/node"
+	"github.com/ish-xyz/dcache/pkg/node/client"
+	"github.com/stretchr/testify/assert"
+)
+
+// Scheduler client that always returns the same peer
+type peerClient struct {
+	client.IClient
+	peer *node.NodeSchema
+}
+
+func (c *peerClient) GetPeers(item string) (*node.NodeSchema, error) {
+	return c.peer, nil
+}
+
+func setupPeer(t *testing.T, no *Node, handler http.HandlerFunc) *httptest.Server {
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	u, _ := url.Parse(srv.URL)
+	port, _ := strconv.Atoi(u.Port())
+	no.Client = &peerClient{peer: &node.NodeSchema{Scheme: "http", IPv4: u.Hostname(), Port: port}}
+	return srv
+}
+
+func TestRequestHops(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/files/file.zip", nil)
+	assert.Equal(t, 0, requestHops(req))
+
+	req.Header.Set(HopsHeader, "2")
+	assert.Equal(t, 2, requestHops(req))
+
+	req.Header.Set(HopsHeader, "-1")
+	assert.Equal(t, 0, requestHops(req))
+
+	req.Header.Set(HopsHeader, "invalid")
+	assert.Equal(t, 0, requestHops(req))
+}
+
+func TestPeerRequest(t *testing.T) {
+	no := setupTestNode(t)
+	srv := setupPeer(t, no, func(w http.ResponseWriter, r *http.Request) {})
+
+	req := httptest.NewRequest(http.MethodGet, "/files/file.zip?version=1", nil)
+	peerReq, ok := no.peerRequest(req, "files-item1")
+	limitReq := httptest.NewRequest(http.MethodGet, "/files/file.zip", nil)
+	limitReq.Header.Set(HopsHeader, "1")
+	_, limitOk := no.peerRequest(limitReq, "files-item1")
+
+	assert.True(t, ok)
+	assert.Equal(t, srv.URL+"/files/file.zip?version=1", peerReq.URL.String())
+	assert.Equal(t, "1", peerReq.Header.Get(HopsHeader))
+	assert.Equal(t, "", req.Header.Get(HopsHeader))
+	assert.False(t, limitOk)
+}
+
+func TestPeerFallback(t *testing.T) {
+	no := setupTestNode(t)
+	proxy := newFakeProxy()
+	proxy.ModifyResponse = no.peerResponse
+	proxy.ErrorHandler = no.peerError
+	fallback := func(w http.ResponseWriter) {
+		fmt.Fprint(w, "upstream")
+	}
+
+	status := http.StatusOK
+	srv := setupPeer(t, no, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+		fmt.Fprint(w, "peer")
+	})
+	serve := func() string {
+		peerReq, _ := no.peerRequest(httptest.NewRequest(http.MethodGet, "/files/file.zip", nil), "files-item1")
+		rec := httptest.NewRecorder()
+		proxy.ServeHTTP(rec, withPeerFallback(peerReq, fallback))
+		return rec.Body.String()
+	}
+
+	served := serve()
+	status = http.StatusNotFound
+	notFound := serve()
+	srv.Close()
+	unreachable := serve()
+
+	assert.Equal(t, "peer", served)
+	assert.Equal(t, "upstream", notFound)
+	assert.Equal(t, "upstream", unreachable)
+}
+
+func TestForwardToPeer(t *testing.T) {
+	no := setupTestNode(t)
+	no.MaxHops = 2
+	var hops string
+	setupPeer(t, no, func(w http.ResponseWriter, r *http.Request) {
+		hops = r.Header.Get(HopsHeader)
+		fmt.Fprint(w, "peer")
+	})
+	proxy := newFakeProxy()
+	proxy.ModifyResponse = no.peerResponse
+	proxy.ErrorHandler = no.peerError
+
+	forwarded := httptest.NewRecorder()
+	forwardedReq := httptest.NewRequest(http.MethodGet, "/files/file.zip", nil)
+	forwardedReq.Header.Set(HopsHeader, "1")
+	no.forwardToPeer(forwarded, forwardedReq, "files-item1", proxy)
+
+	limit := httptest.NewRecorder()
+	limitReq := httptest.NewRequest(http.MethodGet, "/files/file.zip", nil)
+	limitReq.Header.Set(HopsHeader, "2")
+	no.forwardToPeer(limit, limitReq, "files-item1", proxy)
+
+	assert.Equal(t, "peer", forwarded.Body.String())
+	assert.Equal(t, "2", hops)
+	assert.Equal(t, http.StatusNotFound, limit.Code)
+}
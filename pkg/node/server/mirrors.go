@@ -0,0 +1,285 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// States of the circuit breaker of a mirror
+const (
+	circuitClosed   = "closed"    // requests are sent to the mirror
+	circuitOpen     = "open"      // the mirror is skipped until the cooldown is over
+	circuitHalfOpen = "half-open" // cooldown is over, the next request decides the state
+)
+
+type mirror struct {
+	URL       *url.URL
+	mu        sync.Mutex
+	failures  int       // consecutive failures
+	openUntil time.Time // zero if the circuit is closed
+	lastError string
+	lastCheck time.Time
+}
+
+// Status of a mirror, as returned by the status endpoint
+type MirrorStatus struct {
+	URL       string `json:"url"`
+	State     string `json:"state"`
+	Failures  int    `json:"failures"`
+	LastError string `json:"lastError,omitempty"`
+	LastCheck int64  `json:"lastCheck,omitempty"`
+}
+
+type UpstreamStatus struct {
+	Name    string         `json:"name"`
+	Prefix  string         `json:"prefix"`
+	Mirrors []MirrorStatus `json:"mirrors"`
+}
+
+// RoundTripper that sends requests to the first available mirror of an upstream,
+// a mirror is skipped after MaxFailures consecutive failures until Cooldown has passed
+type failoverTransport struct {
+	Mirrors     []*mirror
+	Transport   http.RoundTripper
+	MaxFailures int
+	Cooldown    time.Duration
+	Logger      *logrus.Entry
+}
+
+func newFailoverTransport(addresses []string, transport http.RoundTripper, maxFailures int, cooldown time.Duration, log *logrus.Entry) (*failoverTransport, error) {
+
+	mirrors := make([]*mirror, 0, len(addresses))
+	for _, address := range addresses {
+		u, err := url.Parse(address)
+		if err != nil {
+			return nil, err
+		}
+		mirrors = append(mirrors, &mirror{URL: u})
+	}
+
+	return &failoverTransport{
+		Mirrors:     mirrors,
+		Transport:   transport,
+		MaxFailures: maxFailures,
+		Cooldown:    cooldown,
+		Logger:      log,
+	}, nil
+}
+
+func (m *mirror) state(now time.Time) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.openUntil.IsZero() {
+		return circuitClosed
+	}
+	if now.Before(m.openUntil) {
+		return circuitOpen
+	}
+	return circuitHalfOpen
+}
+
+// Record a failure, returns true if the circuit has just been opened
+func (m *mirror) failure(err error, maxFailures int, cooldown time.Duration) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	m.failures += 1
+	m.lastError = err.Error()
+	if m.failures < maxFailures {
+		return false
+	}
+	wasOpen := now.Before(m.openUntil)
+	m.openUntil = now.Add(cooldown)
+	return !wasOpen
+}
+
+func (m *mirror) success() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.failures = 0
+	m.openUntil = time.Time{}
+	m.lastError = ""
+}
+
+func (m *mirror) status() MirrorStatus {
+	state := m.state(time.Now())
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	st := MirrorStatus{
+		URL:       m.URL.String(),
+		State:     state,
+		Failures:  m.failures,
+		LastError: m.lastError,
+	}
+	if !m.lastCheck.IsZero() {
+		st.LastCheck = m.lastCheck.Unix()
+	}
+	return st
+}
+
+func (ft *failoverTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+
+	now := time.Now()
+	candidates := make([]*mirror, 0, len(ft.Mirrors))
+	for _, m := range ft.Mirrors {
+		if m.state(now) != circuitOpen {
+			candidates = append(candidates, m)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no mirror available for %s", req.URL.String())
+	}
+
+	// requests with a body can be sent only once, unless it can be replayed
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		candidates = candidates[:1]
+	}
+
+	var lastErr error
+	for i, m := range candidates {
+
+		mreq, err := ft.rewrite(req, m, i > 0)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := ft.Transport.RoundTrip(mreq)
+		if err == nil && resp.StatusCode < 500 {
+			m.success()
+			return resp, nil
+		}
+
+		// the client went away, it's not the mirror's fault
+		if req.Context().Err() != nil {
+			return resp, err
+		}
+
+		failure := err
+		if failure == nil {
+			failure = fmt.Errorf("status code %d", resp.StatusCode)
+		}
+		if m.failure(failure, ft.MaxFailures, ft.Cooldown) {
+			ft.Logger.Warnf("circuit opened for mirror %s: %v", m.URL.String(), failure)
+		}
+
+		// the response of the last mirror is returned as it is
+		if i == len(candidates)-1 {
+			return resp, err
+		}
+		if resp != nil {
+			resp.Body.Close()
+		}
+		ft.Logger.Debugf("mirror %s failed, trying the next one: %v", m.URL.String(), failure)
+		lastErr = failure
+	}
+	return nil, lastErr
+}
+
+// Point the request to the mirror, mirrors share the path layout of the primary one
+func (ft *failoverTransport) rewrite(req *http.Request, m *mirror, replay bool) (*http.Request, error) {
+
+	primary := ft.Mirrors[0].URL
+	out := req.Clone(req.Context())
+	out.URL.Scheme = m.URL.Scheme
+	out.URL.Host = m.URL.Host
+	if req.Host == "" || req.Host == primary.Host {
+		out.Host = m.URL.Host
+	}
+	if m.URL.Path != primary.Path {
+		out.URL.Path = singleJoiningSlash(m.URL.Path, strings.TrimPrefix(req.URL.Path, primary.Path))
+		out.URL.RawPath = ""
+	}
+
+	if replay && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return nil, err
+		}
+		out.Body = body
+	}
+	return out, nil
+}
+
+// Periodically send a HEAD request to path on every mirror,
+// so that open circuits are closed as soon as the mirror is back
+func (ft *failoverTransport) runHealthChecks(interval time.Duration, path string) {
+	for {
+		for _, m := range ft.Mirrors {
+			ft.check(m, path, interval)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (ft *failoverTransport) check(m *mirror, path string, timeout time.Duration) {
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	u := *m.URL
+	u.Path = singleJoiningSlash(u.Path, path)
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
+	if err != nil {
+		ft.Logger.Errorf("invalid health check for mirror %s: %v", m.URL.String(), err)
+		return
+	}
+
+	resp, err := ft.Transport.RoundTrip(req)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 500 {
+			err = fmt.Errorf("status code %d", resp.StatusCode)
+		}
+	}
+
+	m.mu.Lock()
+	m.lastCheck = time.Now()
+	m.mu.Unlock()
+
+	if err != nil {
+		if m.failure(err, ft.MaxFailures, ft.Cooldown) {
+			ft.Logger.Warnf("health check failed, circuit opened for mirror %s: %v", m.URL.String(), err)
+		}
+		return
+	}
+	if m.state(time.Now()) != circuitClosed {
+		ft.Logger.Infof("mirror %s is healthy again, closing circuit", m.URL.String())
+	}
+	m.success()
+}
+
+// Return the status of the mirrors of every upstream
+func (no *Node) upstreamsStatusHandler(w http.ResponseWriter, r *http.Request) {
+
+	statuses := make([]UpstreamStatus, 0, len(no.Upstreams))
+	for _, up := range no.Upstreams {
+		st := UpstreamStatus{
+			Name:    up.Name,
+			Prefix:  up.Prefix,
+			Mirrors: []MirrorStatus{},
+		}
+		if up.failover != nil {
+			for _, m := range up.failover.Mirrors {
+				st.Mirrors = append(st.Mirrors, m.status())
+			}
+		}
+		statuses = append(statuses, st)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(statuses)
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupMirrors(t *testing.T, handlers ...http.HandlerFunc) *failoverTransport {
+
+	addresses := make([]string, 0, len(handlers))
+	for _, handler := range handlers {
+		srv := httptest.NewServer(handler)
+		t.Cleanup(srv.Close)
+		addresses = append(addresses, srv.URL)
+	}
+
+	ft, err := newFailoverTransport(addresses, http.DefaultTransport, 2, time.Minute, logrus.NewEntry(logrus.New()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ft
+}
+
+func TestFailoverToNextMirror(t *testing.T) {
+	ft := setupMirrors(t,
+		func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusBadGateway) },
+		func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) },
+	)
+	client := &http.Client{Transport: ft}
+
+	resp, err := client.Get(ft.Mirrors[0].URL.String() + "/file.zip")
+
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, circuitClosed, ft.Mirrors[0].state(time.Now()))
+	assert.Equal(t, 1, ft.Mirrors[0].status().Failures)
+	assert.Equal(t, 0, ft.Mirrors[1].status().Failures)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	primaryHits := 0
+	ft := setupMirrors(t,
+		func(w http.ResponseWriter, r *http.Request) {
+			primaryHits += 1
+			w.WriteHeader(http.StatusInternalServerError)
+		},
+		func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) },
+	)
+	client := &http.Client{Transport: ft}
+
+	for i := 0; i < 4; i++ {
+		resp, err := client.Get(ft.Mirrors[0].URL.String() + "/file.zip")
+		assert.Nil(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+
+	// the circuit is open after 2 failures, the primary isn't contacted anymore
+	assert.Equal(t, 2, primaryHits)
+	assert.Equal(t, circuitOpen, ft.Mirrors[0].state(time.Now()))
+	assert.Equal(t, circuitHalfOpen, ft.Mirrors[0].state(time.Now().Add(2*time.Minute)))
+}
+
+func TestAllMirrorsDown(t *testing.T) {
+	ft := setupMirrors(t,
+		func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusServiceUnavailable) },
+	)
+	client := &http.Client{Transport: ft}
+
+	first, firstErr := client.Get(ft.Mirrors[0].URL.String() + "/file.zip")
+	client.Get(ft.Mirrors[0].URL.String() + "/file.zip")
+	_, openErr := client.Get(ft.Mirrors[0].URL.String() + "/file.zip")
+
+	assert.Nil(t, firstErr)
+	assert.Equal(t, http.StatusServiceUnavailable, first.StatusCode)
+	assert.NotNil(t, openErr)
+}
+
+func TestHealthCheckClosesCircuit(t *testing.T) {
+	healthy := false
+	ft := setupMirrors(t,
+		func(w http.ResponseWriter, r *http.Request) {
+			if !healthy {
+				w.WriteHeader(http.StatusBadGateway)
+			}
+		},
+	)
+
+	ft.check(ft.Mirrors[0], "/", time.Second)
+	ft.check(ft.Mirrors[0], "/", time.Second)
+	openState := ft.Mirrors[0].state(time.Now())
+	healthy = true
+	ft.check(ft.Mirrors[0], "/", time.Second)
+
+	assert.Equal(t, circuitOpen, openState)
+	assert.Equal(t, circuitClosed, ft.Mirrors[0].state(time.Now()))
+	assert.NotZero(t, ft.Mirrors[0].status().LastCheck)
+}
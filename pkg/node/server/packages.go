@@ -0,0 +1,109 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	// npm tarballs, /<package>/-/<package>-<version>.tgz, they can't be republished
+	NpmTarballs = regexp.MustCompile(`(/(?:@[^/]+/)?[^/]+/-/[^/?]+\.tgz)`)
+	// PyPI distributions (wheels and sdists), served by files.pythonhosted.org
+	PyPIFiles = regexp.MustCompile(`(/packages/[^?#]+)`)
+	// Maven artifacts, immutable once released. Snapshots and maven-metadata.xml are metadata
+	MavenArtifacts = regexp.MustCompile(`^([^?]*[^/?])(\?.*)?$`)
+
+	pypiIndexRegex     = regexp.MustCompile(`^/(simple|pypi)/`)
+	mavenMetadataRegex = regexp.MustCompile(`(/maven-metadata\.xml(\.\w+)?$|-SNAPSHOT/)`)
+)
+
+type rewriteKey struct{}
+
+// Mutable content that points to immutable items, e.g.: registry tags and package indexes
+func (u *UpstreamConfig) isMetadata(reqURL *url.URL) bool {
+
+	path := strings.TrimPrefix(reqURL.Path, u.Prefix)
+	switch u.Kind {
+	case KindRegistry:
+		return u.manifestTag(reqURL) != ""
+	case KindNpm:
+		return !NpmTarballs.MatchString(path)
+	case KindPyPI:
+		return pypiIndexRegex.MatchString(path)
+	case KindMaven:
+		return mavenMetadataRegex.MatchString(path)
+	}
+	return false
+}
+
+// Package metadata with links to the upstreams, they're rewritten to point back to the node
+func (u *UpstreamConfig) rewritable(reqURL *url.URL) bool {
+	return (u.Kind == KindNpm || u.Kind == KindPyPI) && u.isMetadata(reqURL)
+}
+
+// Base url the client used to reach the node, the node might be behind a proxy
+func (no *Node) publicURL(r *http.Request) string {
+
+	scheme := no.Scheme
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	host := r.Host
+	if forwarded := r.Header.Get("X-Forwarded-Host"); forwarded != "" {
+		host = forwarded
+	}
+	return fmt.Sprintf("%s://%s", scheme, host)
+}
+
+// Replace the addresses of all the upstreams with their route on the node, so that
+// the links of an upstream can point to another one (e.g.: PyPI index and files)
+func (no *Node) urlReplacer(base string) *strings.Replacer {
+
+	routes := make(map[string]string)
+	for _, up := range no.Upstreams {
+		for _, address := range append([]string{up.Address}, up.Mirrors...) {
+			routes[strings.TrimSuffix(address, "/")+"/"] = fmt.Sprintf("%s%s/", base, up.Prefix)
+		}
+	}
+
+	// the longest address wins when one is the prefix of another
+	addresses := make([]string, 0, len(routes))
+	for address := range routes {
+		addresses = append(addresses, address)
+	}
+	sort.Slice(addresses, func(i, j int) bool {
+		return len(addresses[i]) > len(addresses[j])
+	})
+
+	pairs := make([]string, 0, len(routes)*2)
+	for _, address := range addresses {
+		pairs = append(pairs, address, routes[address])
+	}
+	return strings.NewReplacer(pairs...)
+}
+
+// ModifyResponse hook for the proxies: rewrite the links of package metadata,
+// the original content is cached so that it can be served with any address of the node
+func (no *Node) rewriteResponse(resp *http.Response) error {
+
+	if rewrite, _ := resp.Request.Context().Value(rewriteKey{}).(bool); !rewrite || resp.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to read metadata: %v", err)
+	}
+
+	rewritten := no.urlReplacer(no.publicURL(resp.Request)).Replace(string(body))
+	resp.Body = ioutil.NopCloser(strings.NewReader(rewritten))
+	resp.ContentLength = int64(len(rewritten))
+	resp.Header.Set("Content-Length", fmt.Sprintf("%d", len(rewritten)))
+	return nil
+}
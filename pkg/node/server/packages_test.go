@@ -0,0 +1,134 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/ish-xyz/dcache/pkg/node/metadata"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsMetadata(t *testing.T) {
+	npm := &UpstreamConfig{Kind: KindNpm, Prefix: "/npm"}
+	pypi := &UpstreamConfig{Kind: KindPyPI, Prefix: "/pypi"}
+	maven := &UpstreamConfig{Kind: KindMaven, Prefix: "/maven"}
+	generic := &UpstreamConfig{Kind: KindGeneric, Prefix: "/files"}
+
+	tests := []struct {
+		up       *UpstreamConfig
+		path     string
+		metadata bool
+	}{
+		{npm, "/npm/lodash", true},
+		{npm, "/npm/@babel/core", true},
+		{npm, "/npm/lodash/-/lodash-4.17.21.tgz", false},
+		{npm, "/npm/@babel/core/-/core-7.17.0.tgz", false},
+		{pypi, "/pypi/simple/requests/", true},
+		{pypi, "/pypi/pypi/requests/json", true},
+		{pypi, "/pypi/packages/ab/cd/requests-2.27.1-py2.py3-none-any.whl", false},
+		{maven, "/maven/org/slf4j/slf4j-api/maven-metadata.xml", true},
+		{maven, "/maven/org/slf4j/slf4j-api/maven-metadata.xml.sha1", true},
+		{maven, "/maven/com/example/app/1.0-SNAPSHOT/app-1.0-20220101.jar", true},
+		{maven, "/maven/org/slf4j/slf4j-api/1.7.36/slf4j-api-1.7.36.jar", false},
+		{generic, "/files/maven-metadata.xml", false},
+	}
+	for _, test := range tests {
+		reqURL, _ := url.Parse(test.path)
+		assert.Equal(t, test.metadata, test.up.isMetadata(reqURL), test.path)
+	}
+}
+
+func TestImmutableDigestPackages(t *testing.T) {
+	npm := &UpstreamConfig{Kind: KindNpm, Prefix: "/npm", Immutable: NpmTarballs}
+	maven := &UpstreamConfig{Kind: KindMaven, Prefix: "/maven", Immutable: MavenArtifacts}
+	tarball, _ := url.Parse("/npm/@babel/core/-/core-7.17.0.tgz")
+	jar, _ := url.Parse("/maven/org/slf4j/slf4j-api/1.7.36/slf4j-api-1.7.36.jar")
+	mavenMetadata, _ := url.Parse("/maven/org/slf4j/slf4j-api/maven-metadata.xml")
+	directory, _ := url.Parse("/maven/org/slf4j/")
+
+	assert.Equal(t, "/@babel/core/-/core-7.17.0.tgz", npm.immutableDigest(tarball))
+	assert.Equal(t, "/maven/org/slf4j/slf4j-api/1.7.36/slf4j-api-1.7.36.jar", maven.immutableDigest(jar))
+	assert.Equal(t, "", maven.immutableDigest(mavenMetadata))
+	assert.Equal(t, "", maven.immutableDigest(directory))
+}
+
+func TestURLReplacer(t *testing.T) {
+	no := setupTestNode(t)
+	no.Upstreams = []*UpstreamConfig{
+		{Prefix: "/pypi", Address: "https://pypi.org"},
+		{Prefix: "/pythonhosted", Address: "https://files.pythonhosted.org/", Mirrors: []string{"https://mirror.example.com"}},
+		{Prefix: "/pypisub", Address: "https://pypi.org/sub"},
+	}
+	replacer := no.urlReplacer("http://node:8100")
+
+	assert.Equal(t,
+		`<a href="http://node:8100/pythonhosted/packages/ab/requests.whl#sha256=abc">`,
+		replacer.Replace(`<a href="https://files.pythonhosted.org/packages/ab/requests.whl#sha256=abc">`))
+	assert.Equal(t, "http://node:8100/pythonhosted/packages/a.whl", replacer.Replace("https://mirror.example.com/packages/a.whl"))
+	assert.Equal(t, "http://node:8100/pypisub/simple/", replacer.Replace("https://pypi.org/sub/simple/"))
+	assert.Equal(t, "http://node:8100/pypi/simple/", replacer.Replace("https://pypi.org/simple/"))
+	assert.Equal(t, "https://example.com/file", replacer.Replace("https://example.com/file"))
+}
+
+func TestRewriteResponse(t *testing.T) {
+	no := setupTestNode(t)
+	var upstreamURL string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"dist": {"tarball": "%s/lodash/-/lodash-4.17.21.tgz"}}`, upstreamURL)
+	}))
+	t.Cleanup(srv.Close)
+	upstreamURL = srv.URL
+
+	up := &UpstreamConfig{
+		Name:        "npm",
+		Kind:        KindNpm,
+		Prefix:      "/npm",
+		Address:     srv.URL,
+		Regex:       regexp.MustCompile(".*"),
+		MaxFailures: 3,
+		Cooldown:    time.Minute,
+	}
+	if err := up.init(logrus.NewEntry(logrus.New())); err != nil {
+		t.Fatal(err)
+	}
+	up.proxy.ModifyResponse = no.rewriteResponse
+	no.Upstreams = []*UpstreamConfig{up}
+
+	req := httptest.NewRequest(http.MethodGet, "http://node:8100/npm/lodash", nil)
+	rewritten := httptest.NewRecorder()
+	up.proxy.ServeHTTP(rewritten, req.WithContext(context.WithValue(req.Context(), rewriteKey{}, true)))
+	original := httptest.NewRecorder()
+	up.proxy.ServeHTTP(original, httptest.NewRequest(http.MethodGet, "http://node:8100/npm/lodash", nil))
+
+	assert.Equal(t, `{"dist": {"tarball": "http://node:8100/npm/lodash/-/lodash-4.17.21.tgz"}}`, rewritten.Body.String())
+	assert.Equal(t, fmt.Sprintf("%d", rewritten.Body.Len()), rewritten.Header().Get("Content-Length"))
+	assert.Contains(t, original.Body.String(), srv.URL)
+}
+
+func TestServeItemRewrite(t *testing.T) {
+	no := setupTestNode(t)
+	up := &UpstreamConfig{Name: "npm", Kind: KindNpm, Prefix: "/npm", Address: "https://registry.npmjs.org"}
+	no.Upstreams = []*UpstreamConfig{up}
+	content := `{"dist": {"tarball": "https://registry.npmjs.org/lodash/-/lodash-4.17.21.tgz"}}`
+	ioutil.WriteFile(fmt.Sprintf("%s/npm-item1", no.DataDir), []byte(content), 0644)
+	no.Downloader.Metadata.Write(&metadata.Metadata{Item: "npm-item1", Size: int64(len(content))})
+
+	packument := httptest.NewRecorder()
+	packumentReq := httptest.NewRequest(http.MethodGet, "/npm/lodash", nil)
+	packumentReq.Host = "node:8100"
+	packumentReq.Header.Set("X-Forwarded-Proto", "https")
+	no.serveItem(packument, packumentReq, up, fmt.Sprintf("%s/npm-item1", no.DataDir))
+	tarball := httptest.NewRecorder()
+	no.serveItem(tarball, httptest.NewRequest(http.MethodGet, "/npm/lodash/-/lodash-4.17.21.tgz", nil), up, fmt.Sprintf("%s/npm-item1", no.DataDir))
+
+	assert.Equal(t, `{"dist": {"tarball": "https://node:8100/npm/lodash/-/lodash-4.17.21.tgz"}}`, packument.Body.String())
+	assert.Equal(t, content, tarball.Body.String())
+}
@@ -20,9 +20,13 @@ func newFakeProxy() *httputil.ReverseProxy {
 	return &httputil.ReverseProxy{Director: director}
 }
 
-func newCustomProxy(target *url.URL, prefix string) *httputil.ReverseProxy {
+func newCustomProxy(target *url.URL, prefix string, headers map[string]string) *httputil.ReverseProxy {
 	targetQuery := target.RawQuery
 	director := func(req *http.Request) {
+		// the address used by the client, to rewrite the links in the response
+		if req.Header.Get("X-Forwarded-Host") == "" {
+			req.Header.Set("X-Forwarded-Host", req.Host)
+		}
 		req.URL.Scheme = target.Scheme
 		req.URL.Host = target.Host
 		req.Host = target.Host
@@ -39,6 +43,9 @@ func newCustomProxy(target *url.URL, prefix string) *httputil.ReverseProxy {
 			// explicitly disable User-Agent so it's not set to default value
 			req.Header.Set("User-Agent", "")
 		}
+		for key, value := range headers {
+			req.Header.Set(key, value)
+		}
 	}
 	return &httputil.ReverseProxy{Director: director}
 }
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+var (
+	// Manifests and blobs of a registry upstream, the only cacheable paths
+	RegistryPaths = regexp.MustCompile(`/v2/.+?/(manifests|blobs)/[^/?]+(\?.*)?$`)
+	// Manifests and blobs referenced by digest, cached forever
+	RegistryDigests = regexp.MustCompile(`/v2/.+?/(?:manifests|blobs)/(sha256:[a-f0-9]{64})`)
+
+	manifestRegex = regexp.MustCompile(`/v2/.+?/manifests/([^/?]+)$`)
+)
+
+// Return the tag of a manifest request, empty if the manifest is referenced by digest
+func (u *UpstreamConfig) manifestTag(reqURL *url.URL) string {
+	if u.Kind != KindRegistry {
+		return ""
+	}
+	match := manifestRegex.FindStringSubmatch(reqURL.Path)
+	if match == nil || strings.Contains(match[1], ":") {
+		return ""
+	}
+	return match[1]
+}
+
+// Manifests can be served from the cache with HEAD requests,
+// used by containerd to resolve tags
+func (u *UpstreamConfig) cacheableMethod(r *http.Request) bool {
+	if r.Method == http.MethodGet {
+		return true
+	}
+	return r.Method == http.MethodHead && u.Kind == KindRegistry && manifestRegex.MatchString(r.URL.Path)
+}
+
+// The manifest returned for a tag depends on the media types the client accepts
+// (e.g.: a manifest list or a single platform manifest)
+func acceptKey(r *http.Request) string {
+	var types []string
+	for _, value := range r.Header.Values("Accept") {
+		for _, mediaType := range strings.Split(value, ",") {
+			if mediaType = strings.TrimSpace(mediaType); mediaType != "" {
+				types = append(types, mediaType)
+			}
+		}
+	}
+	return strings.Join(types, ",")
+}
+
+// Serve a registry upstream on /v2/, as a registry mirror for Docker and containerd
+func mirrorHandler(up *UpstreamConfig, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Path = up.Prefix + r.URL.Path
+		if r.URL.RawPath != "" {
+			r.URL.RawPath = up.Prefix + r.URL.RawPath
+		}
+		r.RequestURI = up.Prefix + r.RequestURI
+		handler(w, r)
+	}
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ish-xyz/dcache/pkg/node/metadata"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	indexDigest    = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	manifestDigest = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+)
+
+func setupRegistryUpstream(t *testing.T, heads *int32) *UpstreamConfig {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			atomic.AddInt32(heads, 1)
+		}
+		// clients that don't support manifest lists get the manifest of their platform
+		if strings.Contains(r.Header.Get("Accept"), "application/vnd.oci.image.index.v1+json") {
+			w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+			w.Header().Set("Docker-Content-Digest", indexDigest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+		w.Header().Set("Docker-Content-Digest", manifestDigest)
+	}))
+	t.Cleanup(srv.Close)
+
+	up := &UpstreamConfig{
+		Name:        "docker",
+		Kind:        KindRegistry,
+		Prefix:      "/docker",
+		Address:     srv.URL,
+		Regex:       RegistryPaths,
+		KeyStrategy: KeyDockerContentDigest,
+		MaxFailures: 3,
+		Cooldown:    time.Minute,
+		Immutable:   RegistryDigests,
+		MetadataTTL: time.Minute,
+	}
+	if err := up.init(logrus.NewEntry(logrus.New())); err != nil {
+		t.Fatal(err)
+	}
+	return up
+}
+
+func TestManifestTag(t *testing.T) {
+	registry := &UpstreamConfig{Kind: KindRegistry}
+	generic := &UpstreamConfig{Kind: KindGeneric}
+	tag, _ := url.Parse("/docker/v2/library/alpine/manifests/3.15")
+	digest, _ := url.Parse("/docker/v2/library/alpine/manifests/" + manifestDigest)
+	blob, _ := url.Parse("/docker/v2/library/alpine/blobs/" + manifestDigest)
+
+	assert.Equal(t, "3.15", registry.manifestTag(tag))
+	assert.Equal(t, "", registry.manifestTag(digest))
+	assert.Equal(t, "", registry.manifestTag(blob))
+	assert.Equal(t, "", generic.manifestTag(tag))
+}
+
+func TestRegistryPaths(t *testing.T) {
+	assert.True(t, RegistryPaths.MatchString("/docker/v2/library/alpine/manifests/latest"))
+	assert.True(t, RegistryPaths.MatchString("/docker/v2/library/alpine/blobs/"+manifestDigest+"?ns=docker.io"))
+	assert.False(t, RegistryPaths.MatchString("/docker/v2/"))
+	assert.False(t, RegistryPaths.MatchString("/docker/v2/library/alpine/tags/list"))
+	assert.Equal(t, manifestDigest, RegistryDigests.FindStringSubmatch("/docker/v2/library/alpine/manifests/" + manifestDigest)[1])
+}
+
+func TestItemKeyRegistryTag(t *testing.T) {
+	up := &UpstreamConfig{Name: "docker", Kind: KindRegistry, KeyStrategy: KeyDockerContentDigest}
+	tag, _ := url.Parse("/docker/v2/library/alpine/manifests/latest")
+
+	key, err := up.itemKey(tag, http.Header{"Docker-Content-Digest": []string{manifestDigest}})
+
+	assert.Nil(t, err)
+	assert.Equal(t, up.itemName(digestHash(manifestDigest)), key)
+}
+
+func TestResolveTag(t *testing.T) {
+	var heads int32
+	no := setupTestNode(t)
+	up := setupRegistryUpstream(t, &heads)
+	path := "/v2/library/alpine/manifests/latest"
+	url := up.Address + path
+	host := strings.TrimPrefix(up.Address, "http://")
+
+	resolve := func(accept string) string {
+		req := httptest.NewRequest(http.MethodGet, "/docker"+path, nil)
+		req.Header.Set("Accept", accept)
+		item, ok := no.resolveItem(httptest.NewRecorder(), req, up, up.proxy, url, host)
+		assert.True(t, ok)
+		return item
+	}
+
+	index := resolve("application/vnd.oci.image.index.v1+json, application/vnd.oci.image.manifest.v1+json")
+	// not cached yet, the upstream is asked again
+	uncached := resolve("application/vnd.oci.image.index.v1+json, application/vnd.oci.image.manifest.v1+json")
+	ioutil.WriteFile(fmt.Sprintf("%s/%s", no.DataDir, index), []byte("{}"), 0644)
+	no.Downloader.Metadata.Write(&metadata.Metadata{Item: index, Size: 2})
+	cached := resolve("application/vnd.oci.image.index.v1+json, application/vnd.oci.image.manifest.v1+json")
+	manifest := resolve("application/vnd.oci.image.manifest.v1+json")
+
+	assert.Equal(t, up.itemName(digestHash(indexDigest)), index)
+	assert.Equal(t, index, uncached)
+	assert.Equal(t, index, cached)
+	assert.Equal(t, up.itemName(digestHash(manifestDigest)), manifest)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&heads))
+}
+
+func TestCacheableMethod(t *testing.T) {
+	registry := &UpstreamConfig{Kind: KindRegistry}
+	generic := &UpstreamConfig{Kind: KindGeneric}
+	manifestHead := httptest.NewRequest(http.MethodHead, "/docker/v2/library/alpine/manifests/latest", nil)
+	blobHead := httptest.NewRequest(http.MethodHead, "/docker/v2/library/alpine/blobs/"+manifestDigest, nil)
+
+	assert.True(t, registry.cacheableMethod(manifestHead))
+	assert.False(t, registry.cacheableMethod(blobHead))
+	assert.False(t, generic.cacheableMethod(manifestHead))
+	assert.True(t, generic.cacheableMethod(httptest.NewRequest(http.MethodGet, "/files/file.zip", nil)))
+}
+
+func TestMirrorHandler(t *testing.T) {
+	up := &UpstreamConfig{Prefix: "/docker"}
+	var path, requestURI string
+	handler := mirrorHandler(up, func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		requestURI = r.RequestURI
+	})
+
+	handler(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/v2/library/alpine/manifests/latest?ns=docker.io", nil))
+
+	assert.Equal(t, "/docker/v2/library/alpine/manifests/latest", path)
+	assert.Equal(t, "/docker/v2/library/alpine/manifests/latest?ns=docker.io", requestURI)
+}
@@ -2,102 +2,98 @@ package server
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"net/http/httputil"
-	"net/url"
 	"os"
 	"path/filepath"
-	"regexp"
 	"strings"
+	"time"
 
 	"github.com/ish-xyz/dcache/pkg/node/client"
 	"github.com/ish-xyz/dcache/pkg/node/downloader"
 	"github.com/sirupsen/logrus"
 )
 
-type UpstreamConfig struct {
-	Address  string `validate:"required,url"`
-	Insecure bool   `validate:"required"` // add boolean validator
-}
-
 type Node struct {
 	Client         client.IClient         `validate:"required"`
-	Upstream       *UpstreamConfig        `validate:"required,dive"`
+	Upstreams      []*UpstreamConfig      `validate:"required,min=1,dive"`
 	DataDir        string                 `validate:"required"` // Add dir validator
 	Scheme         string                 `validate:"required"`
 	IPv4           string                 `validate:"required,ipv4"`
 	Port           int                    `validate:"required,number"`
 	MaxConnections int                    `validate:"required,number"`
+	MaxHops        int                    `validate:"min=0"` // peers a request can go through, 0 to disable peers
 	Downloader     *downloader.Downloader `validate:"required"`
-	Regex          *regexp.Regexp         `validate:"required"`
 	Logger         *logrus.Entry          `validate:"required"`
+	inflight       *inflightGroup
+	stale          *staleIndex
+	auth           *authCache
 }
 
 // TODO this can probably be improved, struct is too big and the args on this function are too much
 func NewNode(
 	nc client.IClient,
-	uconf *UpstreamConfig,
+	upstreams []*UpstreamConfig,
 	dataDir,
 	scheme,
 	ipv4 string,
 	port,
-	maxconn int,
+	maxconn,
+	maxHops int,
 	dw *downloader.Downloader,
-	re *regexp.Regexp,
 	lg *logrus.Entry,
 ) *Node {
 
 	return &Node{
 		Client:         nc,
-		Upstream:       uconf,
+		Upstreams:      upstreams,
 		DataDir:        strings.TrimSuffix(dataDir, "/"),
 		Scheme:         strings.TrimSuffix(scheme, "://"),
 		IPv4:           ipv4,
 		Port:           port,
 		MaxConnections: maxconn,
+		MaxHops:        maxHops,
 		Downloader:     dw,
-		Regex:          re,
 		Logger:         lg,
+		inflight:       newInflightGroup(),
+		stale:          newStaleIndex(),
+		auth:           newAuthCache(),
 	}
 }
 
 // ProxyRequestHandler handles the http request using proxy
-func (no *Node) ProxyRequestHandler(upstreamProxy, peerProxy *httputil.ReverseProxy, proxyPath string) func(http.ResponseWriter, *http.Request) {
+func (no *Node) ProxyRequestHandler(up *UpstreamConfig, upstreamProxy, peerProxy *httputil.ReverseProxy) func(http.ResponseWriter, *http.Request) {
 
 	return func(w http.ResponseWriter, r *http.Request) {
 
 		// TODO: what happens if we allow multiple HTTP methods?
-		if no.Regex.MatchString(r.RequestURI) && r.Method == "GET" {
+		if up.Regex.MatchString(r.RequestURI) && up.cacheableMethod(r) {
 
 			no.Logger.Debugln("regex matched for ", r.RequestURI)
 
-			url := fmt.Sprintf("%s%s", no.Upstream.Address, strings.TrimPrefix(r.RequestURI, proxyPath))
-			host := strings.Split(no.Upstream.Address, "://")[1]
-
-			// prepare HEAD request
-			headReq, err := copyRequest(r.Context(), r, url, host, http.MethodHead)
-			if err != nil {
-				no.Logger.Errorln("Error parsing http resource for head request:", err)
-				no.runProxy(upstreamProxy, w, r)
-				return
+			// the metadata gets rewritten, the upstream must send it unencoded
+			rewrite := up.rewritable(r.URL)
+			if rewrite {
+				r.Header.Del("Accept-Encoding")
+				r = r.WithContext(context.WithValue(r.Context(), rewriteKey{}, true))
 			}
 
-			// HEAD request is necessary to see if the upstream allows us to download/serve certain content
-			headResp, err := runRequestCheck(no.Client.GetHttpClient(), headReq)
-			if err != nil {
-				no.Logger.Warnln("falling back to upstream, because of error:", err)
-				no.runProxy(upstreamProxy, w, r)
+			url := fmt.Sprintf("%s%s", up.Address, strings.TrimPrefix(r.RequestURI, up.Prefix))
+			host := strings.Split(up.Address, "://")[1]
+
+			item, ok := no.resolveItem(w, r, up, upstreamProxy, url, host)
+			if !ok {
 				return
 			}
-
-			// File found in local cache, try to serve it
-			item := generateHash(r.URL, headResp.Header["Etag"][0])
 			no.Logger.Debugf("item name: %s", item)
 
+			// File found in local cache, try to serve it
 			filepath := fmt.Sprintf("%s/%s", no.DataDir, item)
-			if _, err := os.Stat(filepath); err == nil {
+			if no.isCached(filepath, r.URL) {
 				selfInfo, err := no.Client.GetNode("self")
 				if err != nil {
 					no.Logger.Errorln("failed to contact scheduler to get node info, fallingback to upstream")
@@ -107,50 +103,185 @@ func (no *Node) ProxyRequestHandler(upstreamProxy, peerProxy *httputil.ReversePr
 
 				no.Logger.Debugln("checking connections, retrieved node info", selfInfo)
 				if selfInfo.Connections+1 < selfInfo.MaxConnections {
-					no.ServeSingleFile(w, r, filepath)
+					no.ServeSingleFile(w, r, up, filepath)
+					return
+				}
+				// the peer that sent the request falls back to the upstream
+				if requestHops(r) > 0 {
+					no.Logger.Warnln("max connections reached, refusing peer request")
+					http.Error(w, "max connections reached", http.StatusServiceUnavailable)
 					return
 				}
-				// TODO: this can be removed but we need to find a way to limit the maximum amount of jumps
 				no.Logger.Warnln("max connections for peer reached, redirecting to upstream")
 				no.runProxy(upstreamProxy, w, r)
 				return
 			}
 
-			// File not found in local cache, try to find a suitable peer
-			peerinfo, err := no.Client.GetPeers(item)
-			if err != nil {
-				downloaderReq, _ := copyRequest(context.TODO(), r, url, host, http.MethodGet)
-				err = no.Downloader.Push(downloaderReq, filepath)
+			// Requests from peers never reach the upstream, so that they can't bounce
+			if requestHops(r) > 0 {
+				no.forwardToPeer(w, r, item, peerProxy)
+				return
+			}
+
+			// HEAD requests are answered only from the local cache
+			if r.Method == http.MethodHead {
+				no.runProxy(upstreamProxy, w, r)
+				return
+			}
+
+			// Partial content can't be cached while being served: follow the
+			// in-progress download if there's one, otherwise proxy the range
+			// and let the downloader fetch the whole item
+			if r.Header.Get("Range") != "" {
+				if target := no.inflight.get(item); target != nil && !rewrite && no.serveInflight(w, r, target) {
+					return
+				}
+				proxy, proxyReq, downloaderReq := no.selectSource(r, up, item, url, host, upstreamProxy, peerProxy)
+				no.runProxy(proxy, w, proxyReq)
+				_, err := no.Downloader.PushWithClient(downloaderReq, filepath, up.client)
 				if err != nil {
 					no.Logger.Errorf("failed to push file %s into downloader queue", filepath)
 				}
-				no.Logger.Errorln("error looking for peer:", err)
-				no.runProxy(upstreamProxy, w, r)
 				return
 			}
 
-			rewriteToPeer(r, peerinfo)
-			url = fmt.Sprintf("%s://%s:%d/%s", peerinfo.Scheme, peerinfo.IPv4, peerinfo.Port, r.URL.Path)
-			host = fmt.Sprintf("%s:%d", peerinfo.IPv4, peerinfo.Port)
-			downloaderReq, _ := copyRequest(context.TODO(), r, url, host, http.MethodGet)
+			// File not found in local cache, if another request is already
+			// fetching it, stream it from the in-progress download (if it doesn't need rewriting)
+			target, leader := no.inflight.join(item, filepath)
+			if !leader {
+				if rewrite || !no.serveInflight(w, r, target) {
+					no.runProxy(upstreamProxy, w, r)
+				}
+				return
+			}
+			defer no.inflight.leave(item)
 
-			err = no.Downloader.Push(downloaderReq, filepath)
-			if err != nil {
-				no.Logger.Errorf("failed to push file %s into downloader queue", filepath)
+			// the previous leader might have completed the download in the meantime
+			if no.isCached(filepath, r.URL) {
+				no.ServeSingleFile(w, r, up, filepath)
+				return
+			}
+
+			// Cache the item while serving it, the downloader is used only
+			// if the response couldn't be fully cached (e.g.: the client went away)
+			cacheReq := r.WithContext(context.WithValue(r.Context(), cacheTargetKey{}, target))
+			proxy, proxyReq, downloaderReq := no.selectSource(cacheReq, up, item, url, host, upstreamProxy, peerProxy)
+			no.runProxy(proxy, w, proxyReq)
+
+			if target.Tee != nil && !target.Tee.Completed() {
+				_, err := no.Downloader.PushWithClient(downloaderReq, filepath, up.client)
+				if err != nil {
+					no.Logger.Errorf("failed to push file %s into downloader queue", filepath)
+				}
 			}
-			no.runProxy(peerProxy, w, r)
 			return
 		}
 		no.runProxy(upstreamProxy, w, r)
 	}
 }
 
+// Return the item name for the request, if it can't be resolved
+// the request has already been served (stale or by the upstream)
+func (no *Node) resolveItem(w http.ResponseWriter, r *http.Request, up *UpstreamConfig, upstreamProxy *httputil.ReverseProxy, url, host string) (string, bool) {
+
+	// immutable items can't change, the upstream is asked only if the client is authorized,
+	// private items always need a successful authorization check
+	if digest := up.immutableDigest(r.URL); digest != "" {
+		item := up.itemName(digestHash(digest))
+		if up.AuthCheck || no.isPrivate(item) {
+			err := no.checkAuth(r, up, url, host)
+			if err != nil {
+				no.Logger.Warnln("authorization check failed, falling back to upstream:", err)
+				no.runProxy(upstreamProxy, w, r)
+				return "", false
+			}
+		}
+		return item, true
+	}
+
+	// metadata (e.g.: registry tags) points to the same item for MetadataTTL,
+	// the item must be cached, otherwise the metadata might get a different content
+	volatile := up.isMetadata(r.URL) && up.MetadataTTL > 0
+	if entry, ok := no.stale.get(staleKey(up, r)); ok && volatile && time.Since(entry.Validated) < up.MetadataTTL &&
+		no.isCached(fmt.Sprintf("%s/%s", no.DataDir, entry.Item), r.URL) {
+		if up.AuthCheck || no.isPrivate(entry.Item) {
+			err := no.checkAuth(r, up, url, host)
+			if err != nil {
+				no.Logger.Warnln("authorization check failed, falling back to upstream:", err)
+				no.runProxy(upstreamProxy, w, r)
+				return "", false
+			}
+		}
+		return entry.Item, true
+	}
+
+	// prepare HEAD request
+	headReq, err := copyRequest(r.Context(), r, url, host, http.MethodHead)
+	if err != nil {
+		no.Logger.Errorln("Error parsing http resource for head request:", err)
+		no.runProxy(upstreamProxy, w, r)
+		return "", false
+	}
+	up.setHeaders(headReq)
+
+	// HEAD request is necessary to see if the upstream allows us to download/serve certain content
+	headResp, err := runRequestCheck(up.client, headReq)
+	if err != nil {
+		if no.serveStale(w, r, up, err) {
+			return "", false
+		}
+		no.Logger.Warnln("falling back to upstream, because of error:", err)
+		no.runProxy(upstreamProxy, w, r)
+		return "", false
+	}
+
+	no.authorized(r, up)
+
+	item, err := up.itemKey(r.URL, headResp.Header)
+	if err != nil {
+		no.Logger.Warnln("can't cache item, falling back to upstream:", err)
+		no.runProxy(upstreamProxy, w, r)
+		return "", false
+	}
+	if up.StaleIfError > 0 || volatile {
+		no.stale.set(staleKey(up, r), item, time.Now())
+	}
+	return item, true
+}
+
+// Look for a peer that has the item, otherwise use the upstream. Returns the proxy
+// to use with its request and a request for the downloader. If the peer fails the
+// request is served by the upstream
+func (no *Node) selectSource(r *http.Request, up *UpstreamConfig, item, url, host string, upstreamProxy, peerProxy *httputil.ReverseProxy) (*httputil.ReverseProxy, *http.Request, *http.Request) {
+
+	downloaderReq, _ := copyRequest(context.TODO(), r, url, host, http.MethodGet)
+	up.setHeaders(downloaderReq)
+
+	// peers would rewrite the metadata with their own address
+	if up.rewritable(r.URL) {
+		return upstreamProxy, r, downloaderReq
+	}
+
+	peerReq, ok := no.peerRequest(r, item)
+	if !ok {
+		return upstreamProxy, r, downloaderReq
+	}
+
+	url = fmt.Sprintf("%s://%s%s", peerReq.URL.Scheme, peerReq.URL.Host, peerReq.URL.RequestURI())
+	downloaderReq, _ = copyRequest(context.TODO(), peerReq, url, peerReq.URL.Host, http.MethodGet)
+
+	fallback := func(w http.ResponseWriter) {
+		no.runProxy(upstreamProxy, w, r)
+	}
+	return peerProxy, withPeerFallback(peerReq, fallback), downloaderReq
+}
+
 func (no *Node) runProxy(proxy *httputil.ReverseProxy, w http.ResponseWriter, r *http.Request) {
 	no.Logger.Infoln("proxying request for:", r.URL.String())
 	proxy.ServeHTTP(w, r)
 }
 
-func (no *Node) ServeSingleFile(w http.ResponseWriter, r *http.Request, itemPath string) {
+func (no *Node) ServeSingleFile(w http.ResponseWriter, r *http.Request, up *UpstreamConfig, itemPath string) {
 
 	err := no.Client.AddConnection()
 	if err != nil {
@@ -160,7 +291,7 @@ func (no *Node) ServeSingleFile(w http.ResponseWriter, r *http.Request, itemPath
 	no.Logger.Infoln("serving file", r.RequestURI)
 	no.Downloader.GC.UpdateAtime(filepath.Base(itemPath))
 
-	http.ServeFile(w, r, itemPath)
+	no.serveItem(w, r, up, itemPath)
 
 	err = no.Client.RemoveConnection()
 	if err != nil {
@@ -169,20 +300,128 @@ func (no *Node) ServeSingleFile(w http.ResponseWriter, r *http.Request, itemPath
 
 }
 
+// Serve an item with the headers of the original response
+func (no *Node) serveItem(w http.ResponseWriter, r *http.Request, up *UpstreamConfig, itemPath string) {
+
+	file, err := os.Open(itemPath)
+	if err != nil {
+		no.Logger.Errorf("failed to open item %s: %v", itemPath, err)
+		http.NotFound(w, r)
+		return
+	}
+	defer file.Close()
+
+	fi, err := file.Stat()
+	if err != nil {
+		no.Logger.Errorf("failed to stat item %s: %v", itemPath, err)
+		http.NotFound(w, r)
+		return
+	}
+
+	// the original Last-Modified is used for conditional requests instead of the mtime
+	modtime := fi.ModTime()
+	if md, ok := no.Downloader.Metadata.Get(filepath.Base(itemPath)); ok {
+		for key, values := range md.Header {
+			w.Header()[key] = values
+		}
+		if t, err := http.ParseTime(md.Header.Get("Last-Modified")); err == nil {
+			modtime = t
+		}
+	}
+
+	if !up.rewritable(r.URL) {
+		http.ServeContent(w, r, fi.Name(), modtime, file)
+		return
+	}
+
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		no.Logger.Errorf("failed to read item %s: %v", itemPath, err)
+		http.NotFound(w, r)
+		return
+	}
+	rewritten := no.urlReplacer(no.publicURL(r)).Replace(string(content))
+	http.ServeContent(w, r, fi.Name(), modtime, strings.NewReader(rewritten))
+}
+
 func (no *Node) Run() error {
 
-	proxyPath := "/proxy"
 	address := fmt.Sprintf("%s:%d", no.IPv4, no.Port)
 	fakeProxy := newFakeProxy()
-	url, err := url.Parse(no.Upstream.Address)
+	fakeProxy.ModifyResponse = no.peerResponse
+	fakeProxy.ErrorHandler = no.peerError
+
+	names := make(map[string]bool)
+	prefixes := make(map[string]bool)
+	var mirror *UpstreamConfig
+	for _, up := range no.Upstreams {
+		up.Prefix = strings.TrimSuffix(up.Prefix, "/")
+		if names[up.Name] {
+			return fmt.Errorf("duplicated upstream name %s", up.Name)
+		}
+		if prefixes[up.Prefix] {
+			return fmt.Errorf("duplicated upstream prefix %s", up.Prefix)
+		}
+		if up.Mirror && up.Kind != KindRegistry {
+			return fmt.Errorf("upstream %s of kind %s can't be a registry mirror", up.Name, up.Kind)
+		}
+		if up.Mirror && mirror != nil {
+			return fmt.Errorf("upstreams %s and %s are both registry mirrors", mirror.Name, up.Name)
+		}
+		names[up.Name] = true
+		prefixes[up.Prefix] = true
+
+		err := up.init(no.Logger.WithField("upstream", up.Name))
+		if err != nil {
+			return fmt.Errorf("invalid upstream %s: %v", up.Name, err)
+		}
+		up.proxy.ModifyResponse = func(resp *http.Response) error {
+			if err := no.cacheResponse(resp); err != nil {
+				return err
+			}
+			return no.rewriteResponse(resp)
+		}
+
+		no.Logger.Infof("routing %s/ to upstream %s (%s)", up.Prefix, up.Name, up.Address)
+		handler := no.ProxyRequestHandler(up, up.proxy, fakeProxy)
+		http.HandleFunc(fmt.Sprintf("%s/", up.Prefix), handler)
+
+		if up.Mirror {
+			mirror = up
+			no.Logger.Infof("routing /v2/ to registry upstream %s", up.Name)
+			http.HandleFunc("/v2/", mirrorHandler(up, handler))
+		}
+	}
+
+	http.HandleFunc("/_dcache/upstreams", no.upstreamsStatusHandler)
+	http.HandleFunc("/_dcache/items", no.itemsHandler)
+	http.HandleFunc("/_dcache/downloads", no.downloadsHandler)
+
+	// downloads queued before a restart need the clients of the upstreams
+	replayed, err := no.Downloader.Replay(no.downloadClient)
 	if err != nil {
-		return err
+		no.Logger.Errorln("failed to replay download queue:", err)
+	} else if replayed > 0 {
+		no.Logger.Infof("replayed %d queued downloads", replayed)
 	}
-	proxy := newCustomProxy(url, proxyPath)
 
 	no.Logger.Infof("starting up server on %s", address)
-	http.HandleFunc(fmt.Sprintf("%s/", proxyPath), no.ProxyRequestHandler(proxy, fakeProxy, proxyPath))
 
 	log.Fatal(http.ListenAndServe(address, nil))
 	return nil
 }
+
+// List the items in the local cache with their metadata
+func (no *Node) itemsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(no.Downloader.Metadata.List())
+}
+
+// Status of the download queue
+func (no *Node) downloadsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(no.Downloader.Stats())
+}
+
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 )
 
 // Generate item hash
@@ -17,6 +19,16 @@ func generateHash(url *url.URL, etag string) string {
 	return fmt.Sprintf("%x", sumBytes)
 }
 
+// Returned by runRequestCheck when the status code isn't 200 or 304
+type statusCodeError struct {
+	Method     string
+	StatusCode int
+}
+
+func (e *statusCodeError) Error() string {
+	return fmt.Sprintf("status code of %s request is not 200 or 304, is: %d", e.Method, e.StatusCode)
+}
+
 // Perform an http request and checks the status code
 func runRequestCheck(client *http.Client, req *http.Request) (*http.Response, error) {
 
@@ -27,7 +39,7 @@ func runRequestCheck(client *http.Client, req *http.Request) (*http.Response, er
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 && resp.StatusCode != 304 {
-		return nil, fmt.Errorf("status code of %s request is not 200 or 304, is: %d", req.Method, resp.StatusCode)
+		return nil, &statusCodeError{Method: req.Method, StatusCode: resp.StatusCode}
 	}
 
 	return resp, nil
@@ -48,3 +60,52 @@ func copyRequest(ctx context.Context, orig *http.Request, newurl, newhost, metho
 	newReq.URL = u
 	return newReq, nil
 }
+
+var errRangeNotSatisfiable = fmt.Errorf("range not satisfiable")
+
+// Parse a single byte range of a content of known size,
+// multiple ranges are not supported
+func parseRange(header string, size int64) (start, length int64, err error) {
+
+	spec := strings.TrimPrefix(header, "bytes=")
+	if spec == header || strings.Contains(spec, ",") {
+		return 0, 0, fmt.Errorf("unsupported range %s", header)
+	}
+
+	parts := strings.SplitN(strings.TrimSpace(spec), "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid range %s", header)
+	}
+
+	// suffix range, last n bytes
+	if parts[0] == "" {
+		n, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, fmt.Errorf("invalid range %s", header)
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, n, nil
+	}
+
+	start, err = strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, fmt.Errorf("invalid range %s", header)
+	}
+	if start >= size {
+		return 0, 0, errRangeNotSatisfiable
+	}
+
+	end := size - 1
+	if parts[1] != "" {
+		end, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || end < start {
+			return 0, 0, fmt.Errorf("invalid range %s", header)
+		}
+		if end >= size {
+			end = size - 1
+		}
+	}
+	return start, end - start + 1, nil
+}
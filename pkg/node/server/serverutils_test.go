@@ -0,0 +1,30 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseRange(t *testing.T) {
+
+	start, length, err := parseRange("bytes=2-5", 10)
+	openStart, openLength, openErr := parseRange("bytes=4-", 10)
+	suffixStart, suffixLength, suffixErr := parseRange("bytes=-3", 10)
+	clampStart, clampLength, clampErr := parseRange("bytes=8-20", 10)
+	_, _, unsatisfiableErr := parseRange("bytes=10-", 10)
+	_, _, multiErr := parseRange("bytes=0-1,4-5", 10)
+	_, _, invalidErr := parseRange("items=0-1", 10)
+
+	assert.Nil(t, err)
+	assert.Equal(t, []int64{2, 4}, []int64{start, length})
+	assert.Nil(t, openErr)
+	assert.Equal(t, []int64{4, 6}, []int64{openStart, openLength})
+	assert.Nil(t, suffixErr)
+	assert.Equal(t, []int64{7, 3}, []int64{suffixStart, suffixLength})
+	assert.Nil(t, clampErr)
+	assert.Equal(t, []int64{8, 2}, []int64{clampStart, clampLength})
+	assert.Equal(t, errRangeNotSatisfiable, unsatisfiableErr)
+	assert.NotNil(t, multiErr)
+	assert.NotNil(t, invalidErr)
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Last item cached for each url, used to serve stale content when the upstream
+// isn't available and to resolve the tags of registry upstreams
+type staleIndex struct {
+	mu      sync.Mutex
+	entries map[string]staleEntry
+}
+
+type staleEntry struct {
+	Item      string
+	Validated time.Time // last time the upstream confirmed the item
+}
+
+func newStaleIndex() *staleIndex {
+	return &staleIndex{
+		entries: make(map[string]staleEntry),
+	}
+}
+
+func (si *staleIndex) set(key, item string, validated time.Time) {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	si.entries[key] = staleEntry{Item: item, Validated: validated}
+}
+
+func (si *staleIndex) get(key string) (staleEntry, bool) {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	entry, ok := si.entries[key]
+	return entry, ok
+}
+
+func (si *staleIndex) delete(key string) {
+	si.mu.Lock()
+	defer si.mu.Unlock()
+	delete(si.entries, key)
+}
+
+func staleKey(up *UpstreamConfig, r *http.Request) string {
+	// the content negotiated by registries and package indexes depends on Accept
+	if up.Kind != KindGeneric {
+		return fmt.Sprintf("%s %s %s", up.Name, r.URL.RequestURI(), acceptKey(r))
+	}
+	return fmt.Sprintf("%s %s", up.Name, r.URL.RequestURI())
+}
+
+// Errors that the stale content can be served for: the upstream
+// is unreachable or broken, not when it denies or doesn't have the item
+func isUpstreamFailure(err error) bool {
+	var statusErr *statusCodeError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode >= 500
+	}
+	return err != nil
+}
+
+// Serve the last known version of the item if stale-if-error is enabled for the upstream,
+// returns false if there's no version recent enough
+func (no *Node) serveStale(w http.ResponseWriter, r *http.Request, up *UpstreamConfig, checkErr error) bool {
+
+	if up.StaleIfError <= 0 || !isUpstreamFailure(checkErr) {
+		return false
+	}
+
+	key := staleKey(up, r)
+	entry, ok := no.stale.get(key)
+	if !ok {
+		return false
+	}
+
+	age := time.Since(entry.Validated)
+	if age > up.StaleIfError {
+		no.Logger.Debugf("not serving stale item %s, last validated %s ago", entry.Item, age)
+		return false
+	}
+
+	filePath := fmt.Sprintf("%s/%s", no.DataDir, entry.Item)
+	if !no.isCached(filePath, r.URL) {
+		no.stale.delete(key)
+		return false
+	}
+
+	// the upstream can't be asked, only a previous authorization of the client is valid
+	if no.isPrivate(entry.Item) && !no.auth.valid(authKey(up, r)) {
+		no.Logger.Debugf("not serving stale item %s, client not authorized", entry.Item)
+		return false
+	}
+
+	no.Logger.Warnf("upstream check failed, serving stale item %s last validated %s ago: %v", entry.Item, age.Round(time.Second), checkErr)
+	w.Header().Set("X-Dcache-Stale", "true")
+	w.Header().Set("Warning", `110 dcache "Response is Stale"`)
+	no.ServeSingleFile(w, r, up, filePath)
+	return true
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/ish-xyz/dcache/pkg/node/client"
+	"github.com/ish-xyz/dcache/pkg/node/downloader"
+	"github.com/ish-xyz/dcache/pkg/node/metadata"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupTestNode(t *testing.T) *Node {
+	dataDir := t.TempDir()
+	log := logrus.NewEntry(logrus.New())
+	dw := downloader.NewDownloader(log, dataDir, time.Hour, time.Hour, 1024, 1, 1, 100, 0, 0)
+	nc := client.NewClient("node1", nil, "http://127.0.0.1:1", log)
+	return NewNode(nc, nil, dataDir, "http", "127.0.0.1", 8100, 10, 1, dw, log)
+}
+
+func TestIsUpstreamFailure(t *testing.T) {
+	assert.True(t, isUpstreamFailure(fmt.Errorf("connection refused")))
+	assert.True(t, isUpstreamFailure(&statusCodeError{Method: "HEAD", StatusCode: 503}))
+	assert.False(t, isUpstreamFailure(&statusCodeError{Method: "HEAD", StatusCode: 404}))
+	assert.False(t, isUpstreamFailure(&statusCodeError{Method: "HEAD", StatusCode: 401}))
+	assert.False(t, isUpstreamFailure(nil))
+}
+
+func TestServeStale(t *testing.T) {
+	no := setupTestNode(t)
+	up := &UpstreamConfig{Name: "files", StaleIfError: time.Hour}
+	disabled := &UpstreamConfig{Name: "other"}
+	req := httptest.NewRequest(http.MethodGet, "/files/file.zip", nil)
+	upstreamErr := fmt.Errorf("connection refused")
+	ioutil.WriteFile(fmt.Sprintf("%s/files-item1", no.DataDir), []byte("content"), 0644)
+	no.Downloader.Metadata.Write(&metadata.Metadata{Item: "files-item1", Size: 7})
+
+	missing := httptest.NewRecorder()
+	missingServed := no.serveStale(missing, req, up, upstreamErr)
+
+	no.stale.set(staleKey(up, req), "files-item1", time.Now().Add(-2*time.Hour))
+	expired := httptest.NewRecorder()
+	expiredServed := no.serveStale(expired, req, up, upstreamErr)
+
+	no.stale.set(staleKey(up, req), "files-item1", time.Now())
+	notFound := httptest.NewRecorder()
+	notFoundServed := no.serveStale(notFound, req, up, &statusCodeError{Method: "HEAD", StatusCode: 404})
+	disabledServed := no.serveStale(httptest.NewRecorder(), req, disabled, upstreamErr)
+	stale := httptest.NewRecorder()
+	staleServed := no.serveStale(stale, req, up, upstreamErr)
+
+	os.Remove(fmt.Sprintf("%s/files-item1", no.DataDir))
+	deletedServed := no.serveStale(httptest.NewRecorder(), req, up, upstreamErr)
+	_, indexed := no.stale.get(staleKey(up, req))
+
+	assert.False(t, missingServed)
+	assert.False(t, expiredServed)
+	assert.False(t, notFoundServed)
+	assert.False(t, disabledServed)
+	assert.True(t, staleServed)
+	assert.Equal(t, http.StatusOK, stale.Code)
+	assert.Equal(t, "content", stale.Body.String())
+	assert.Equal(t, "true", stale.Header().Get("X-Dcache-Stale"))
+	assert.NotEmpty(t, stale.Header().Get("Warning"))
+	assert.False(t, deletedServed)
+	assert.False(t, indexed)
+}
+
+func TestServeStalePrivate(t *testing.T) {
+	no := setupTestNode(t)
+	up := &UpstreamConfig{Name: "files", StaleIfError: time.Hour, AuthTTL: time.Minute}
+	req := httptest.NewRequest(http.MethodGet, "/files/file.zip", nil)
+	req.Header.Set("Authorization", "Bearer token")
+	upstreamErr := fmt.Errorf("connection refused")
+	ioutil.WriteFile(fmt.Sprintf("%s/files-item1", no.DataDir), []byte("content"), 0644)
+	no.Downloader.Metadata.Write(&metadata.Metadata{Item: "files-item1", Size: 7, Private: true})
+	no.stale.set(staleKey(up, req), "files-item1", time.Now())
+
+	unauthorizedServed := no.serveStale(httptest.NewRecorder(), req, up, upstreamErr)
+	no.authorized(req, up)
+	authorizedServed := no.serveStale(httptest.NewRecorder(), req, up, upstreamErr)
+
+	assert.False(t, unauthorizedServed)
+	assert.True(t, authorizedServed)
+}
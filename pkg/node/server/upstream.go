@@ -0,0 +1,219 @@
+package server
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Strategies to build the cache key of an item
+const (
+	KeyAuto                = "auto" // first available among etag, docker-content-digest and last-modified
+	KeyETag                = "etag"
+	KeyDockerContentDigest = "docker-content-digest"
+	KeyLastModified        = "last-modified" // Last-Modified + Content-Length
+	KeyURLDigest           = "url-digest"    // digest extracted from the url with KeyRegex
+	KeyURL                 = "url"           // url only, the item is refreshed every KeyTTL
+)
+
+// Kinds of upstream
+const (
+	KindGeneric  = "generic"  // any http server, tuned with Regex and KeyStrategy
+	KindRegistry = "registry" // Docker Registry v2 API
+	KindNpm      = "npm"
+	KindPyPI     = "pypi"
+	KindMaven    = "maven"
+)
+
+type UpstreamConfig struct {
+	Name         string            `validate:"required,alphanum"` // items of this upstream are named <name>-<hash>
+	Kind         string            `validate:"oneof=generic registry npm pypi maven"`
+	Prefix       string            `validate:"required,startswith=/"`
+	Address      string            `validate:"required,url"`
+	Mirrors      []string          `validate:"dive,url"` // tried in order when Address is not available
+	Insecure     bool              // skip TLS verification
+	Regex        *regexp.Regexp    `validate:"required"` // cacheable paths
+	Headers      map[string]string // added to the requests sent to the upstream
+	KeyStrategy  string            `validate:"oneof=auto etag docker-content-digest last-modified url-digest url"`
+	KeyRegex     *regexp.Regexp    // used by url-digest, the first capture group is the digest
+	KeyTTL       time.Duration     // used by url
+	MaxFailures  int               `validate:"required,min=1"` // consecutive failures before a mirror is skipped
+	Cooldown     time.Duration     `validate:"required"`       // time a failing mirror is skipped for
+	HealthCheck  *HealthCheck
+	StaleIfError time.Duration  // max staleness of items served when the upstream fails, 0 to disable
+	Immutable    *regexp.Regexp // content addressed urls served without HEAD check, the first capture group is the digest
+	AuthCheck    bool           // validate the client credentials with the upstream before serving immutable items
+	AuthTTL      time.Duration  // time successful authorization checks are cached for
+	Username     string         // credentials for the token server, used for the clients without credentials
+	Password     string
+	MetadataTTL  time.Duration // time the metadata (e.g.: tags, package indexes) is served without asking the upstream
+	Mirror       bool          // serve the registry upstream on /v2/ too, as a registry mirror
+	client       *http.Client
+	proxy        *httputil.ReverseProxy
+	failover     *failoverTransport
+}
+
+// Disabled if Interval is 0
+type HealthCheck struct {
+	Interval time.Duration
+	Path     string
+}
+
+// Setup the http client and the reverse proxy of the upstream,
+// both fail over to the mirrors and answer bearer challenges
+func (u *UpstreamConfig) init(log *logrus.Entry) error {
+
+	target, err := url.Parse(u.Address)
+	if err != nil {
+		return err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if u.Insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	addresses := append([]string{u.Address}, u.Mirrors...)
+	u.failover, err = newFailoverTransport(addresses, transport, u.MaxFailures, u.Cooldown, log)
+	if err != nil {
+		return err
+	}
+
+	bearer := newBearerTransport(u.failover, transport, u.Username, u.Password)
+	u.client = &http.Client{Transport: bearer}
+	u.proxy = newCustomProxy(target, u.Prefix, u.Headers)
+	u.proxy.Transport = bearer
+
+	if u.HealthCheck != nil && u.HealthCheck.Interval > 0 {
+		go u.failover.runHealthChecks(u.HealthCheck.Interval, u.HealthCheck.Path)
+	}
+	return nil
+}
+
+// Add the configured headers to a request for the upstream
+func (u *UpstreamConfig) setHeaders(req *http.Request) {
+	for key, value := range u.Headers {
+		req.Header.Set(key, value)
+	}
+}
+
+// Item names are namespaced by upstream, so that
+// different upstreams can share the same data dir
+func (u *UpstreamConfig) itemName(hash string) string {
+	return fmt.Sprintf("%s-%s", u.Name, hash)
+}
+
+// Return the item name for a request, using the headers
+// of the upstream response to the HEAD check
+func (u *UpstreamConfig) itemKey(reqURL *url.URL, header http.Header) (string, error) {
+
+	hash, err := u.hashKey(reqURL, header)
+	if err != nil {
+		return "", err
+	}
+	return u.itemName(hash), nil
+}
+
+func (u *UpstreamConfig) hashKey(reqURL *url.URL, header http.Header) (string, error) {
+
+	// a tag resolves to the same item as the digest of its manifest
+	if u.manifestTag(reqURL) != "" {
+		if digest := header.Get("Docker-Content-Digest"); digest != "" {
+			return digestHash(digest), nil
+		}
+	}
+
+	switch u.KeyStrategy {
+	case KeyAuto:
+		for _, strategy := range []string{KeyETag, KeyDockerContentDigest, KeyLastModified} {
+			if key, err := keyFromHeaders(strategy, header); err == nil {
+				return generateHash(reqURL, key), nil
+			}
+		}
+		return "", fmt.Errorf("upstream response has no ETag, Docker-Content-Digest or Last-Modified")
+
+	case KeyURLDigest:
+		if u.KeyRegex == nil {
+			return "", fmt.Errorf("no regex configured for key strategy %s", KeyURLDigest)
+		}
+		match := u.KeyRegex.FindStringSubmatch(reqURL.String())
+		if len(match) < 2 || match[1] == "" {
+			return "", fmt.Errorf("no digest found in url %s", reqURL.String())
+		}
+		return digestHash(match[1]), nil
+
+	case KeyURL:
+		if u.KeyTTL <= 0 {
+			return "", fmt.Errorf("no ttl configured for key strategy %s", KeyURL)
+		}
+		window := time.Now().Unix() / int64(u.KeyTTL.Seconds())
+		return generateHash(reqURL, fmt.Sprintf("ttl-%d", window)), nil
+
+	default:
+		key, err := keyFromHeaders(u.KeyStrategy, header)
+		if err != nil {
+			return "", err
+		}
+		return generateHash(reqURL, key), nil
+	}
+}
+
+// Return the digest in the url if it matches the immutable rule
+func (u *UpstreamConfig) immutableDigest(reqURL *url.URL) string {
+	if u.Immutable == nil || u.isMetadata(reqURL) {
+		return ""
+	}
+	match := u.Immutable.FindStringSubmatch(reqURL.String())
+	if len(match) < 2 {
+		return ""
+	}
+	return match[1]
+}
+
+// Content addressed, the same digest is the same item whatever the url is
+func digestHash(digest string) string {
+	return generateHash(&url.URL{}, digest)
+}
+
+func keyFromHeaders(strategy string, header http.Header) (string, error) {
+
+	switch strategy {
+	case KeyETag:
+		if etag := header.Get("Etag"); etag != "" {
+			return etag, nil
+		}
+		return "", fmt.Errorf("upstream response has no ETag")
+	case KeyDockerContentDigest:
+		if digest := header.Get("Docker-Content-Digest"); digest != "" {
+			return digest, nil
+		}
+		return "", fmt.Errorf("upstream response has no Docker-Content-Digest")
+	case KeyLastModified:
+		lastModified := header.Get("Last-Modified")
+		contentLength := header.Get("Content-Length")
+		if lastModified != "" && contentLength != "" {
+			return fmt.Sprintf("%s.%s", lastModified, contentLength), nil
+		}
+		return "", fmt.Errorf("upstream response has no Last-Modified or Content-Length")
+	}
+	return "", fmt.Errorf("invalid key strategy %s", strategy)
+}
+
+// Client of the upstream the download request is sent to, nil if it goes to a peer
+func (no *Node) downloadClient(req *http.Request) *http.Client {
+	for _, up := range no.Upstreams {
+		for _, address := range append([]string{up.Address}, up.Mirrors...) {
+			u, err := url.Parse(address)
+			if err == nil && u.Host == req.URL.Host {
+				return up.client
+			}
+		}
+	}
+	return nil
+}
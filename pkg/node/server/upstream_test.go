@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestItemKeyAuto(t *testing.T) {
+	u := &UpstreamConfig{Name: "files", KeyStrategy: KeyAuto}
+	reqURL, _ := url.Parse("http://upstream/file.zip")
+
+	etagKey, etagErr := u.itemKey(reqURL, http.Header{"Etag": []string{"abc"}})
+	digestKey, digestErr := u.itemKey(reqURL, http.Header{"Docker-Content-Digest": []string{"sha256:abc"}})
+	modifiedKey, modifiedErr := u.itemKey(reqURL, http.Header{
+		"Last-Modified":  []string{"Mon, 01 Jan 2022 00:00:00 GMT"},
+		"Content-Length": []string{"10"},
+	})
+	_, missingErr := u.itemKey(reqURL, http.Header{})
+
+	assert.Nil(t, etagErr)
+	assert.Equal(t, "files-"+generateHash(reqURL, "abc"), etagKey)
+	assert.Nil(t, digestErr)
+	assert.Equal(t, "files-"+generateHash(reqURL, "sha256:abc"), digestKey)
+	assert.Nil(t, modifiedErr)
+	assert.Equal(t, "files-"+generateHash(reqURL, "Mon, 01 Jan 2022 00:00:00 GMT.10"), modifiedKey)
+	assert.NotNil(t, missingErr)
+}
+
+func TestItemKeyURLDigest(t *testing.T) {
+	u := &UpstreamConfig{
+		KeyStrategy: KeyURLDigest,
+		KeyRegex:    regexp.MustCompile(`sha256:([a-f0-9]+)`),
+	}
+	first, _ := url.Parse("http://upstream/v2/alpine/blobs/sha256:abc")
+	second, _ := url.Parse("http://upstream/v2/busybox/blobs/sha256:abc")
+	other, _ := url.Parse("http://upstream/file.zip")
+
+	firstKey, firstErr := u.itemKey(first, http.Header{})
+	secondKey, secondErr := u.itemKey(second, http.Header{})
+	_, otherErr := u.itemKey(other, http.Header{})
+
+	assert.Nil(t, firstErr)
+	assert.Nil(t, secondErr)
+	assert.Equal(t, firstKey, secondKey)
+	assert.NotNil(t, otherErr)
+}
+
+func TestItemKeyURL(t *testing.T) {
+	u := &UpstreamConfig{KeyStrategy: KeyURL, KeyTTL: time.Hour}
+	noTTL := &UpstreamConfig{KeyStrategy: KeyURL}
+	reqURL, _ := url.Parse("http://upstream/file.zip")
+
+	key, err := u.itemKey(reqURL, http.Header{})
+	_, noTTLErr := noTTL.itemKey(reqURL, http.Header{})
+
+	assert.Nil(t, err)
+	assert.NotEmpty(t, key)
+	assert.NotNil(t, noTTLErr)
+}
+
+func TestItemKeyNamespace(t *testing.T) {
+	first := &UpstreamConfig{Name: "dockerhub", KeyStrategy: KeyETag}
+	second := &UpstreamConfig{Name: "internal", KeyStrategy: KeyETag}
+	reqURL, _ := url.Parse("/v2/alpine/blobs/sha256:abc")
+	header := http.Header{"Etag": []string{"abc"}}
+
+	firstKey, _ := first.itemKey(reqURL, header)
+	secondKey, _ := second.itemKey(reqURL, header)
+
+	assert.True(t, strings.HasPrefix(firstKey, "dockerhub-"))
+	assert.True(t, strings.HasPrefix(secondKey, "internal-"))
+	assert.NotEqual(t, firstKey, secondKey)
+}
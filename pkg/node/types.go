@@ -7,4 +7,13 @@ type NodeSchema struct {
 	MaxConnections int    `json:"maxConnections" validate:"required,number"`
 	Port           int    `json:"port" validate:"required"`
 	Scheme         string `json:"scheme" validate:"required"`
+	LastSeen       int64  `json:"lastSeen"` // unix timestamp of the last lease renewal
+	Healthy        bool   `json:"healthy"`
+}
+
+// Fields that can be updated on a registered node, nil fields are left untouched
+type NodeUpdateSchema struct {
+	MaxConnections *int    `json:"maxConnections,omitempty"`
+	Port           *int    `json:"port,omitempty"`
+	Scheme         *string `json:"scheme,omitempty"`
 }
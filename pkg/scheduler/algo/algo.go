@@ -0,0 +1,31 @@
+package algo
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/ish-xyz/dcache/pkg/node"
+)
+
+// PeerSelector picks the node that should serve an item,
+// candidates are nodes that have the item and at least one free connection
+type PeerSelector interface {
+	Select(candidates []*node.NodeSchema) *node.NodeSchema
+}
+
+// Registered algorithms, keys are lower case
+var algorithms = map[string]func() PeerSelector{
+	"leastconnections": NewLeastConnections,
+	"roundrobin":       NewRoundRobin,
+	"weightedrandom":   NewWeightedRandom,
+	"random":           NewRandom,
+}
+
+// Initialise peer selector by name (case insensitive)
+func NewPeerSelector(name string) (PeerSelector, error) {
+	constructor, ok := algorithms[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("invalid scheduling algorithm %s", name)
+	}
+	return constructor(), nil
+}
@@ -0,0 +1,89 @@
+package algo
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/ish-xyz/dcache/pkg/node"
+	"github.com/stretchr/testify/assert"
+)
+
+func dummyCandidates() []*node.NodeSchema {
+	return []*node.NodeSchema{
+		{Name: "node1", Connections: 3, MaxConnections: 10},
+		{Name: "node2", Connections: 1, MaxConnections: 10},
+		{Name: "node3", Connections: 9, MaxConnections: 10},
+	}
+}
+
+func TestNewPeerSelector(t *testing.T) {
+	lc, lcErr := NewPeerSelector("leastConnections")
+	rr, rrErr := NewPeerSelector("RoundRobin")
+	wr, wrErr := NewPeerSelector("weightedrandom")
+	r, rErr := NewPeerSelector("Random")
+	invalid, invalidErr := NewPeerSelector("fastest")
+
+	assert.Nil(t, lcErr)
+	assert.IsType(t, &LeastConnections{}, lc)
+	assert.Nil(t, rrErr)
+	assert.IsType(t, &RoundRobin{}, rr)
+	assert.Nil(t, wrErr)
+	assert.IsType(t, &WeightedRandom{}, wr)
+	assert.Nil(t, rErr)
+	assert.IsType(t, &Random{}, r)
+	assert.Nil(t, invalid)
+	assert.NotNil(t, invalidErr)
+}
+
+func TestLeastConnections(t *testing.T) {
+	lc := NewLeastConnections()
+
+	candidate := lc.Select(dummyCandidates())
+
+	assert.Equal(t, "node2", candidate.Name)
+	assert.Nil(t, lc.Select(nil))
+}
+
+func TestRoundRobin(t *testing.T) {
+	rr := NewRoundRobin()
+	candidates := dummyCandidates()
+
+	picked := []string{}
+	for i := 0; i < 4; i++ {
+		picked = append(picked, rr.Select(candidates).Name)
+	}
+
+	assert.Equal(t, []string{"node1", "node2", "node3", "node1"}, picked)
+	assert.Nil(t, rr.Select(nil))
+}
+
+func TestWeightedRandom(t *testing.T) {
+	wr := &WeightedRandom{Rand: rand.New(rand.NewSource(1))}
+	candidates := []*node.NodeSchema{
+		{Name: "full", Connections: 10, MaxConnections: 10},
+		{Name: "busy", Connections: 9, MaxConnections: 10},
+		{Name: "idle", Connections: 0, MaxConnections: 10},
+	}
+
+	picked := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		picked[wr.Select(candidates).Name]++
+	}
+
+	assert.Equal(t, 0, picked["full"])
+	assert.Greater(t, picked["idle"], picked["busy"])
+	assert.Nil(t, wr.Select(candidates[:1]))
+}
+
+func TestRandom(t *testing.T) {
+	r := &Random{Rand: rand.New(rand.NewSource(1))}
+	candidates := dummyCandidates()
+
+	picked := map[string]int{}
+	for i := 0; i < 300; i++ {
+		picked[r.Select(candidates).Name]++
+	}
+
+	assert.Equal(t, 3, len(picked))
+	assert.Nil(t, r.Select(nil))
+}
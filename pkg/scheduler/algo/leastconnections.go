@@ -0,0 +1,25 @@
+package algo
+
+import "github.com/ish-xyz/dcache/pkg/node"
+
+// Pick the node with the least number of connections
+type LeastConnections struct{}
+
+func NewLeastConnections() PeerSelector {
+	return &LeastConnections{}
+}
+
+func (lc *LeastConnections) Select(candidates []*node.NodeSchema) *node.NodeSchema {
+
+	var candidate *node.NodeSchema
+
+	for _, n := range candidates {
+		if candidate == nil || n.Connections < candidate.Connections {
+			candidate = n
+		}
+		if candidate.Connections == 0 {
+			break
+		}
+	}
+	return candidate
+}
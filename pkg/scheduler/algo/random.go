@@ -0,0 +1,74 @@
+package algo
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/ish-xyz/dcache/pkg/node"
+)
+
+// Pick a random candidate
+type Random struct {
+	mu   sync.Mutex
+	Rand *rand.Rand
+}
+
+// Pick a random candidate, weighted by free connection slots
+type WeightedRandom struct {
+	mu   sync.Mutex
+	Rand *rand.Rand
+}
+
+func NewRandom() PeerSelector {
+	return &Random{
+		Rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func NewWeightedRandom() PeerSelector {
+	return &WeightedRandom{
+		Rand: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (r *Random) Select(candidates []*node.NodeSchema) *node.NodeSchema {
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return candidates[r.Rand.Intn(len(candidates))]
+}
+
+func (wr *WeightedRandom) Select(candidates []*node.NodeSchema) *node.NodeSchema {
+
+	total := 0
+	for _, n := range candidates {
+		if free := n.MaxConnections - n.Connections; free > 0 {
+			total += free
+		}
+	}
+	if total == 0 {
+		return nil
+	}
+
+	wr.mu.Lock()
+	pick := wr.Rand.Intn(total)
+	wr.mu.Unlock()
+
+	for _, n := range candidates {
+		free := n.MaxConnections - n.Connections
+		if free <= 0 {
+			continue
+		}
+		if pick < free {
+			return n
+		}
+		pick -= free
+	}
+	return nil
+}
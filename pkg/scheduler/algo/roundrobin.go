@@ -0,0 +1,31 @@
+package algo
+
+import (
+	"sync"
+
+	"github.com/ish-xyz/dcache/pkg/node"
+)
+
+// Cycle through the candidates, one request each
+type RoundRobin struct {
+	mu   sync.Mutex
+	next int
+}
+
+func NewRoundRobin() PeerSelector {
+	return &RoundRobin{}
+}
+
+func (rr *RoundRobin) Select(candidates []*node.NodeSchema) *node.NodeSchema {
+
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	rr.mu.Lock()
+	defer rr.mu.Unlock()
+
+	candidate := candidates[rr.next%len(candidates)]
+	rr.next++
+	return candidate
+}
@@ -1,8 +1,12 @@
 package scheduler
 
 import (
+	"sort"
+	"time"
+
 	"github.com/go-playground/validator"
 	"github.com/ish-xyz/dcache/pkg/node"
+	"github.com/ish-xyz/dcache/pkg/scheduler/algo"
 	"github.com/ish-xyz/dcache/pkg/scheduler/storage"
 	"github.com/sirupsen/logrus"
 )
@@ -12,17 +16,40 @@ import (
 
 var validate *validator.Validate
 
+// Filters for the list of nodes, nil/empty fields match every node
+type NodeFilter struct {
+	Healthy   *bool
+	Available *bool // node has at least one free connection
+	Scheme    string
+}
+
 type Scheduler struct {
-	Algo  string
-	Store storage.Storage
+	Algo       string
+	Store      storage.Storage
+	Selector   algo.PeerSelector
+	NodeTTL    time.Duration // nodes without lease renewals are marked unhealthy after this
+	NodeExpiry time.Duration // nodes without lease renewals are deleted after this
 }
 
-func NewScheduler(val *validator.Validate, store storage.Storage, algo string) *Scheduler {
+func NewScheduler(
+	val *validator.Validate,
+	store storage.Storage,
+	algoName string,
+	nodeTTL,
+	nodeExpiry time.Duration,
+) (*Scheduler, error) {
 	validate = val
-	return &Scheduler{
-		Algo:  algo, //@ish-xyz 21/08/2022 TODO: not fully implemented yet
-		Store: store,
+	selector, err := algo.NewPeerSelector(algoName)
+	if err != nil {
+		return nil, err
 	}
+	return &Scheduler{
+		Algo:       algoName,
+		Store:      store,
+		Selector:   selector,
+		NodeTTL:    nodeTTL,
+		NodeExpiry: nodeExpiry,
+	}, nil
 }
 
 // Add connection for specified node
@@ -66,9 +93,120 @@ func (sch *Scheduler) createNode(node *node.NodeSchema) error {
 	if err != nil {
 		return err
 	}
+	node.LastSeen = time.Now().Unix()
+	node.Healthy = true
 	return sch.Store.WriteNode(node, true)
 }
 
+// Update connection settings of a registered node
+func (sch *Scheduler) updateNode(nodeName string, changes *node.NodeUpdateSchema) error {
+
+	return sch.Store.UpdateNode(nodeName, func(n *node.NodeSchema) error {
+		if changes.MaxConnections != nil {
+			n.MaxConnections = *changes.MaxConnections
+		}
+		if changes.Port != nil {
+			n.Port = *changes.Port
+		}
+		if changes.Scheme != nil {
+			n.Scheme = *changes.Scheme
+		}
+		return validate.Struct(n)
+	})
+}
+
+// Remove node from list of nodes and from the index
+func (sch *Scheduler) deleteNode(nodeName string) error {
+
+	return sch.Store.DeleteNode(nodeName)
+}
+
+// List registered nodes sorted by name
+func (sch *Scheduler) listNodes(filter *NodeFilter) ([]*node.NodeSchema, error) {
+
+	nodes, err := sch.Store.ListNodes()
+	if err != nil {
+		return nil, err
+	}
+
+	filtered := []*node.NodeSchema{}
+	for _, n := range nodes {
+		if filter.Healthy != nil && n.Healthy != *filter.Healthy {
+			continue
+		}
+		if filter.Available != nil && (n.Connections < n.MaxConnections) != *filter.Available {
+			continue
+		}
+		if filter.Scheme != "" && n.Scheme != filter.Scheme {
+			continue
+		}
+		filtered = append(filtered, n)
+	}
+
+	sort.Slice(filtered, func(i, j int) bool {
+		return filtered[i].Name < filtered[j].Name
+	})
+	return filtered, nil
+}
+
+// Called by nodes periodically to signal that they are still alive
+func (sch *Scheduler) renewLease(nodeName string) error {
+
+	node, err := sch.Store.ReadNode(nodeName)
+	if err != nil {
+		return err
+	}
+	node.LastSeen = time.Now().Unix()
+	node.Healthy = true
+	return sch.Store.WriteNode(node, true)
+}
+
+// Mark nodes that didn't renew their lease as unhealthy,
+// and delete them (together with their items) once the lease is expired
+func (sch *Scheduler) expireNodes() error {
+
+	nodes, err := sch.Store.ListNodes()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for _, node := range nodes {
+		age := now.Sub(time.Unix(node.LastSeen, 0))
+
+		if age > sch.NodeExpiry {
+			logrus.Warnf("lease expired for node %s, deleting it", node.Name)
+			err := sch.Store.DeleteNode(node.Name)
+			if err != nil {
+				logrus.Errorf("failed to delete node %s: %v", node.Name, err)
+			}
+			continue
+		}
+
+		if age > sch.NodeTTL && node.Healthy {
+			logrus.Warnf("node %s missed its lease renewal, marking it as unhealthy", node.Name)
+			node.Healthy = false
+			err := sch.Store.WriteNode(node, true)
+			if err != nil {
+				logrus.Errorf("failed to update node %s: %v", node.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Background routine that expires dead nodes
+func (sch *Scheduler) RunReaper() {
+	interval := sch.NodeTTL / 2
+	for {
+		err := sch.expireNodes()
+		if err != nil {
+			logrus.Errorln("failed to expire nodes:", err)
+		}
+		time.Sleep(interval)
+	}
+}
+
 // Called by the client when the download of a given item is completed
 func (sch *Scheduler) addNodeForItem(item, nodeName string) error {
 
@@ -78,7 +216,7 @@ func (sch *Scheduler) addNodeForItem(item, nodeName string) error {
 // Used by garbage collector when removing items
 func (sch *Scheduler) removeNodeForItem(item, nodeName string, force bool) error {
 
-	_item, err := sch.Store.ReadIndex(item)
+	_, err := sch.Store.ReadIndex(item)
 	if err != nil {
 		return nil
 	}
@@ -86,12 +224,36 @@ func (sch *Scheduler) removeNodeForItem(item, nodeName string, force bool) error
 		return sch.Store.WriteIndex(item, nodeName, storage.Add)
 	}
 	sch.Store.WriteIndex(item, nodeName, storage.Remove)
+
+	// read the index again, storages might return a copy
+	_item, err := sch.Store.ReadIndex(item)
+	if err != nil {
+		return nil
+	}
 	if _item[nodeName] <= 0 {
 		sch.Store.WriteIndex(item, nodeName, storage.Destroy)
 	}
 	return nil
 }
 
+// Get nodes holding an item, with their scores
+func (sch *Scheduler) getItem(item string) (map[string]int, error) {
+
+	return sch.Store.ReadIndex(item)
+}
+
+// List a page of items, optionally only the ones held by a node
+func (sch *Scheduler) listItems(nodeName, cursor string, limit int) ([]string, string, error) {
+
+	if nodeName == "" {
+		return sch.Store.ListItems(cursor, limit)
+	}
+	if _, err := sch.Store.ReadNode(nodeName); err != nil {
+		return nil, "", err
+	}
+	return sch.Store.ListNodeItems(nodeName, cursor, limit)
+}
+
 // Get NodeSchema from storage
 func (sch *Scheduler) getNode(nodeName string) (*node.NodeSchema, error) {
 
@@ -103,24 +265,22 @@ func (sch *Scheduler) getNode(nodeName string) (*node.NodeSchema, error) {
 	return node, nil
 }
 
-// Look for all the nodes that have a specific item,
-// then look for the node that has the least connection
+// Look for all the nodes that have a specific item and a free connection,
+// then let the configured algorithm pick one of them
 // if node not found, return nil
 func (sch *Scheduler) getPeers(item string) (*node.NodeSchema, error) {
 
-	// Init dummy candidate
-	candidate := &node.NodeSchema{
-		Name:           "",
-		MaxConnections: 10,
-		Connections:    11,
-	}
-
 	nodes, err := sch.Store.ReadIndex(item)
 	if err != nil {
 		return nil, nil
 	}
 
-	for nodeName := range nodes {
+	candidates := []*node.NodeSchema{}
+	for nodeName, score := range nodes {
+
+		if score <= 0 {
+			continue
+		}
 
 		node, err := sch.Store.ReadNode(nodeName)
 		if err != nil {
@@ -128,21 +288,23 @@ func (sch *Scheduler) getPeers(item string) (*node.NodeSchema, error) {
 			continue
 		}
 
-		if node.Connections < node.MaxConnections && node.Connections < candidate.Connections {
-			candidate = node
+		if !node.Healthy {
+			logrus.Debugf("scheduling: node %s is unhealthy, skipping", nodeName)
+			continue
 		}
 
-		logrus.Debugln("candidate node is:", candidate)
-
-		if candidate.Connections == 0 {
-			return candidate, nil
+		if node.Connections < node.MaxConnections {
+			candidates = append(candidates, node)
 		}
 	}
 
-	// If it's still the dummy candidate, then return nil
-	if candidate.Connections == candidate.MaxConnections+1 {
-		return nil, nil
-	}
+	// map iteration is random, keep a stable order for the algorithms
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].Name < candidates[j].Name
+	})
+
+	candidate := sch.Selector.Select(candidates)
+	logrus.Debugln("candidate node is:", candidate)
 
-	return nil, nil
+	return candidate, nil
 }
@@ -0,0 +1,154 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-playground/validator"
+	"github.com/ish-xyz/dcache/pkg/node"
+	"github.com/ish-xyz/dcache/pkg/scheduler/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupScheduler(t *testing.T) *Scheduler {
+	store, _ := storage.NewStorage("memory", map[string]string{})
+	sch, err := NewScheduler(
+		validator.New(),
+		store,
+		"LeastConnections",
+		time.Duration(30)*time.Second,
+		time.Duration(5)*time.Minute,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sch
+}
+
+func dummyNode(name string) *node.NodeSchema {
+	return &node.NodeSchema{
+		Name:           name,
+		IPv4:           "10.0.0.1",
+		Port:           8100,
+		Scheme:         "http",
+		MaxConnections: 10,
+	}
+}
+
+func TestExpireNodes(t *testing.T) {
+	sch := setupScheduler(t)
+	now := time.Now()
+
+	sch.createNode(dummyNode("alive"))
+	sch.createNode(dummyNode("unhealthy"))
+	sch.createNode(dummyNode("dead"))
+	sch.addNodeForItem("item1", "dead")
+	sch.addNodeForItem("item1", "unhealthy")
+
+	unhealthy, _ := sch.getNode("unhealthy")
+	unhealthy.LastSeen = now.Add(-time.Minute).Unix()
+	dead, _ := sch.getNode("dead")
+	dead.LastSeen = now.Add(-time.Hour).Unix()
+
+	err := sch.expireNodes()
+	alive, aliveErr := sch.getNode("alive")
+	unhealthy, unhealthyErr := sch.getNode("unhealthy")
+	_, deadErr := sch.getNode("dead")
+	_item, _ := sch.Store.ReadIndex("item1")
+	peer, peerErr := sch.getPeers("item1")
+
+	assert.Nil(t, err)
+	assert.Nil(t, aliveErr)
+	assert.True(t, alive.Healthy)
+	assert.Nil(t, unhealthyErr)
+	assert.False(t, unhealthy.Healthy)
+	assert.NotNil(t, deadErr)
+	assert.Equal(t, map[string]int{"unhealthy": 1}, _item)
+	assert.Nil(t, peerErr)
+	assert.Nil(t, peer)
+}
+
+func TestRenewLease(t *testing.T) {
+	sch := setupScheduler(t)
+
+	sch.createNode(dummyNode("node1"))
+	_node, _ := sch.getNode("node1")
+	_node.LastSeen = 0
+	_node.Healthy = false
+
+	err := sch.renewLease("node1")
+	missingErr := sch.renewLease("node2")
+
+	assert.Nil(t, err)
+	assert.True(t, _node.Healthy)
+	assert.Greater(t, _node.LastSeen, int64(0))
+	assert.NotNil(t, missingErr)
+}
+
+func TestUpdateNode(t *testing.T) {
+	sch := setupScheduler(t)
+	sch.createNode(dummyNode("node1"))
+	maxConns := 20
+	scheme := "https"
+	invalidMaxConns := 0
+
+	err := sch.updateNode("node1", &node.NodeUpdateSchema{MaxConnections: &maxConns, Scheme: &scheme})
+	invalidErr := sch.updateNode("node1", &node.NodeUpdateSchema{MaxConnections: &invalidMaxConns})
+	missingErr := sch.updateNode("node2", &node.NodeUpdateSchema{})
+	_node, _ := sch.getNode("node1")
+
+	assert.Nil(t, err)
+	assert.NotNil(t, invalidErr)
+	assert.NotNil(t, missingErr)
+	assert.Equal(t, 20, _node.MaxConnections)
+	assert.Equal(t, "https", _node.Scheme)
+	assert.Equal(t, 8100, _node.Port)
+}
+
+func TestListAndDeleteNodes(t *testing.T) {
+	sch := setupScheduler(t)
+	healthy := true
+	available := false
+	sch.createNode(dummyNode("node2"))
+	sch.createNode(dummyNode("node1"))
+	sch.createNode(dummyNode("node3"))
+	sch.setNodeConnections("node3", 10)
+	sch.addNodeForItem("item1", "node1")
+
+	all, allErr := sch.listNodes(&NodeFilter{Healthy: &healthy})
+	full, _ := sch.listNodes(&NodeFilter{Available: &available})
+	deleteErr := sch.deleteNode("node1")
+	remaining, _ := sch.listNodes(&NodeFilter{})
+	_item, _ := sch.Store.ReadIndex("item1")
+
+	assert.Nil(t, allErr)
+	assert.Equal(t, 3, len(all))
+	assert.Equal(t, "node1", all[0].Name)
+	assert.Equal(t, 1, len(full))
+	assert.Equal(t, "node3", full[0].Name)
+	assert.Nil(t, deleteErr)
+	assert.Equal(t, 2, len(remaining))
+	assert.NotContains(t, _item, "node1")
+}
+
+func TestListItems(t *testing.T) {
+	sch := setupScheduler(t)
+	sch.createNode(dummyNode("node1"))
+	sch.addNodeForItem("item1", "node1")
+	sch.addNodeForItem("item2", "node1")
+	sch.addNodeForItem("item3", "node2")
+
+	items, next, err := sch.listItems("", "", 2)
+	nodeItems, _, nodeErr := sch.listItems("node1", "", 10)
+	_, _, missingErr := sch.listItems("node3", "", 10)
+	index, indexErr := sch.getItem("item1")
+
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"init", "item1"}, items)
+	assert.Equal(t, "item1", next)
+	assert.Nil(t, nodeErr)
+	assert.Equal(t, []string{"item1", "item2"}, nodeItems)
+	assert.NotNil(t, missingErr)
+	assert.Nil(t, indexErr)
+	assert.Equal(t, map[string]int{"node1": 1}, index)
+}
@@ -2,6 +2,7 @@ package scheduler
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"strconv"
@@ -13,6 +14,9 @@ import (
 
 var (
 	requestIDKey = "X-Request-Id"
+
+	defaultPageLimit = 100
+	maxPageLimit     = 1000
 )
 
 type Server struct {
@@ -22,9 +26,13 @@ type Server struct {
 }
 
 type Response struct {
-	Status  string           `json:"status"`
-	Message string           `json:"message,omitempty"`
-	Node    *node.NodeSchema `json:"node,omitempty"`
+	Status  string             `json:"status"`
+	Message string             `json:"message,omitempty"`
+	Node    *node.NodeSchema   `json:"node,omitempty"`
+	Nodes   []*node.NodeSchema `json:"nodes,omitempty"`
+	Items   []string           `json:"items,omitempty"`
+	Index   map[string]int     `json:"index,omitempty"`
+	Next    string             `json:"next,omitempty"`
 }
 
 func NewServer(addr string, sch *Scheduler) *Server {
@@ -45,12 +53,18 @@ func (s *Server) Run() {
 	r.HandleFunc("/v1/connections/{nodeName}", s.removeNodeConnection).Methods("DELETE")
 	r.HandleFunc("/v1/connections/{nodeName}/{conns}", s.setNodeConnections).Methods("PUT")
 
-	// Nodes handlers (TODO: finish missing APIs)
+	// Nodes handlers
 	r.HandleFunc("/v1/nodes", s.createNode).Methods("POST")
-	//r.HandleFunc("/v1/nodes/{nodeName}", s.deleteNode).Methods("DELETE")
-	//r.HandleFunc("/v1/nodes/{nodeName}", s.updateNode).Methods("PUT")
+	r.HandleFunc("/v1/nodes", s.listNodes).Methods("GET")
+	r.HandleFunc("/v1/nodes/{nodeName}", s.deleteNode).Methods("DELETE")
+	r.HandleFunc("/v1/nodes/{nodeName}", s.updateNode).Methods("PUT")
 	r.HandleFunc("/v1/nodes/{nodeName}", s.getNode).Methods("GET")
+	r.HandleFunc("/v1/nodes/{nodeName}/items", s.listItems).Methods("GET")
+
+	r.HandleFunc("/v1/leases/{nodeName}", s.renewLease).Methods("PUT")
 
+	r.HandleFunc("/v1/items", s.listItems).Methods("GET")
+	r.HandleFunc("/v1/items/{item}", s.getItem).Methods("GET")
 	r.HandleFunc("/v1/items/{item}/{nodeName}", s.removeNodeForItem).Methods("DELETE")
 	r.HandleFunc("/v1/items/{item}/{nodeName}", s.addNodeForItem).Methods("POST")
 
@@ -150,6 +164,142 @@ func (s *Server) getNode(w http.ResponseWriter, r *http.Request) {
 	jsonApiResponse(w, r, 200, resp)
 }
 
+func (s *Server) listNodes(w http.ResponseWriter, r *http.Request) {
+
+	var resp Response
+	filter := &NodeFilter{
+		Scheme: r.URL.Query().Get("scheme"),
+	}
+
+	for param, field := range map[string]**bool{
+		"healthy":   &filter.Healthy,
+		"available": &filter.Available,
+	} {
+		value := r.URL.Query().Get(param)
+		if value == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			logrus.Warnln("_listNodes:", err.Error())
+			resp.Status = "error"
+			resp.Message = fmt.Sprintf("invalid value for filter %s", param)
+			jsonApiResponse(w, r, 400, resp)
+			return
+		}
+		*field = &b
+	}
+
+	nodes, err := s.Scheduler.listNodes(filter)
+	if err != nil {
+		logrus.Warnln("_listNodes:", err.Error())
+		resp.Status = "error"
+		resp.Message = err.Error()
+		jsonApiResponse(w, r, 500, resp)
+		return
+	}
+
+	resp.Status = "success"
+	resp.Nodes = nodes
+	jsonApiResponse(w, r, 200, resp)
+}
+
+func (s *Server) updateNode(w http.ResponseWriter, r *http.Request) {
+
+	var resp Response
+	var changes node.NodeUpdateSchema
+	vars := mux.Vars(r)
+	nodeName := vars["nodeName"]
+	body, _ := ioutil.ReadAll(r.Body)
+
+	err := json.Unmarshal(body, &changes)
+	if err != nil {
+		logrus.Warnln("_updateNode:", err.Error())
+		resp.Status = "error"
+		resp.Message = err.Error()
+		jsonApiResponse(w, r, 400, resp)
+		return
+	}
+
+	if _, err := s.Scheduler.getNode(nodeName); err != nil {
+		logrus.Warnln("_updateNode:", err.Error())
+		resp.Status = "error"
+		resp.Message = err.Error()
+		jsonApiResponse(w, r, 404, resp)
+		return
+	}
+
+	err = s.Scheduler.updateNode(nodeName, &changes)
+	if err != nil {
+		logrus.Warnln("_updateNode:", err.Error())
+		resp.Status = "error"
+		resp.Message = err.Error()
+		jsonApiResponse(w, r, 500, resp)
+		return
+	}
+
+	resp.Status = "success"
+	resp.Message = "node updated"
+	jsonApiResponse(w, r, 200, resp)
+}
+
+func (s *Server) deleteNode(w http.ResponseWriter, r *http.Request) {
+
+	var resp Response
+	vars := mux.Vars(r)
+	nodeName := vars["nodeName"]
+
+	if _, err := s.Scheduler.getNode(nodeName); err != nil {
+		logrus.Warnln("_deleteNode:", err.Error())
+		resp.Status = "error"
+		resp.Message = err.Error()
+		jsonApiResponse(w, r, 404, resp)
+		return
+	}
+
+	err := s.Scheduler.deleteNode(nodeName)
+	if err != nil {
+		logrus.Warnln("_deleteNode:", err.Error())
+		resp.Status = "error"
+		resp.Message = err.Error()
+		jsonApiResponse(w, r, 500, resp)
+		return
+	}
+
+	resp.Status = "success"
+	resp.Message = "node deleted"
+	jsonApiResponse(w, r, 200, resp)
+}
+
+func (s *Server) renewLease(w http.ResponseWriter, r *http.Request) {
+
+	var resp Response
+	vars := mux.Vars(r)
+	nodeName := vars["nodeName"]
+
+	// nodes need to know if they've been expired, so they can register again
+	if _, err := s.Scheduler.getNode(nodeName); err != nil {
+		logrus.Warnln("_renewLease:", err.Error())
+		resp.Status = "error"
+		resp.Message = err.Error()
+		jsonApiResponse(w, r, 404, resp)
+		return
+	}
+
+	err := s.Scheduler.renewLease(nodeName)
+	if err != nil {
+		logrus.Warnln("_renewLease:", err.Error())
+		resp.Status = "error"
+		resp.Message = err.Error()
+		jsonApiResponse(w, r, 500, resp)
+		return
+	}
+
+	resp.Status = "success"
+	resp.Message = "lease renewed"
+	jsonApiResponse(w, r, 200, resp)
+}
+
 func (s *Server) addNodeConnection(w http.ResponseWriter, r *http.Request) {
 
 	var resp Response
@@ -220,6 +370,62 @@ func (s *Server) setNodeConnections(w http.ResponseWriter, r *http.Request) {
 	jsonApiResponse(w, r, 200, resp)
 }
 
+func (s *Server) getItem(w http.ResponseWriter, r *http.Request) {
+
+	var resp Response
+	vars := mux.Vars(r)
+	item := vars["item"]
+
+	index, err := s.Scheduler.getItem(item)
+	if err != nil {
+		logrus.Warnln("_getItem:", err.Error())
+		resp.Status = "error"
+		resp.Message = err.Error()
+		jsonApiResponse(w, r, 404, resp)
+		return
+	}
+
+	resp.Status = "success"
+	resp.Index = index
+	jsonApiResponse(w, r, 200, resp)
+}
+
+// List items, paginated with ?cursor=<last item of previous page>&limit=<n>
+// when called on /v1/nodes/{nodeName}/items only the items of that node are listed
+func (s *Server) listItems(w http.ResponseWriter, r *http.Request) {
+
+	var resp Response
+	vars := mux.Vars(r)
+	nodeName := vars["nodeName"]
+	cursor := r.URL.Query().Get("cursor")
+
+	limit := defaultPageLimit
+	if limitParam := r.URL.Query().Get("limit"); limitParam != "" {
+		_limit, err := strconv.Atoi(limitParam)
+		if err != nil || _limit <= 0 || _limit > maxPageLimit {
+			resp.Status = "error"
+			resp.Message = fmt.Sprintf("limit must be a number between 1 and %d", maxPageLimit)
+			jsonApiResponse(w, r, 400, resp)
+			return
+		}
+		limit = _limit
+	}
+
+	items, next, err := s.Scheduler.listItems(nodeName, cursor, limit)
+	if err != nil {
+		logrus.Warnln("_listItems:", err.Error())
+		resp.Status = "error"
+		resp.Message = err.Error()
+		jsonApiResponse(w, r, 500, resp)
+		return
+	}
+
+	resp.Status = "success"
+	resp.Items = items
+	resp.Next = next
+	jsonApiResponse(w, r, 200, resp)
+}
+
 func (s *Server) addNodeForItem(w http.ResponseWriter, r *http.Request) {
 
 	var resp Response
@@ -0,0 +1,289 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/ish-xyz/dcache/pkg/node"
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	defaultFilePath = "/var/dcache/scheduler.db"
+)
+
+var (
+	nodesBucket = []byte("nodes")
+	indexBucket = []byte("index")
+)
+
+// Embedded key/value storage, useful for single scheduler deployments
+// that need to survive restarts without running an external database
+type FileStorage struct {
+	DB *bolt.DB
+}
+
+// Initialise file storage, supported options are: path
+func NewFileStorage(opts map[string]string) (*FileStorage, error) {
+
+	path := defaultFilePath
+	if v, ok := opts["path"]; ok && v != "" {
+		path = v
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), os.FileMode(0755))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %v", err)
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open storage file %s: %v", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{nodesBucket, indexBucket} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to initialise storage file %s: %v", path, err)
+	}
+
+	return &FileStorage{DB: db}, nil
+}
+
+func (store *FileStorage) WriteNode(node *node.NodeSchema, force bool) error {
+
+	payload, err := json.Marshal(node)
+	if err != nil {
+		return err
+	}
+
+	return store.DB.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(nodesBucket)
+		if b.Get([]byte(node.Name)) != nil && !force {
+			return fmt.Errorf("node already exists")
+		}
+		return b.Put([]byte(node.Name), payload)
+	})
+}
+
+func (store *FileStorage) ReadNode(nodeName string) (*node.NodeSchema, error) {
+
+	var _node node.NodeSchema
+
+	err := store.DB.View(func(tx *bolt.Tx) error {
+		payload := tx.Bucket(nodesBucket).Get([]byte(nodeName))
+		if payload == nil {
+			return fmt.Errorf("node does not exists")
+		}
+		return json.Unmarshal(payload, &_node)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &_node, nil
+}
+
+func (store *FileStorage) ListNodes() ([]*node.NodeSchema, error) {
+
+	nodes := []*node.NodeSchema{}
+
+	err := store.DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(nodesBucket).ForEach(func(k, v []byte) error {
+			var _node node.NodeSchema
+			err := json.Unmarshal(v, &_node)
+			if err != nil {
+				return fmt.Errorf("invalid payload for node %s: %v", string(k), err)
+			}
+			nodes = append(nodes, &_node)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return nodes, nil
+}
+
+func (store *FileStorage) UpdateNode(nodeName string, update func(*node.NodeSchema) error) error {
+
+	return store.DB.Update(func(tx *bolt.Tx) error {
+		var _node node.NodeSchema
+
+		b := tx.Bucket(nodesBucket)
+		payload := b.Get([]byte(nodeName))
+		if payload == nil {
+			return fmt.Errorf("node does not exists")
+		}
+		err := json.Unmarshal(payload, &_node)
+		if err != nil {
+			return err
+		}
+
+		err = update(&_node)
+		if err != nil {
+			return err
+		}
+		payload, err = json.Marshal(&_node)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(nodeName), payload)
+	})
+}
+
+func (store *FileStorage) DeleteNode(nodeName string) error {
+
+	return store.DB.Update(func(tx *bolt.Tx) error {
+		nodes := tx.Bucket(nodesBucket)
+		if nodes.Get([]byte(nodeName)) == nil {
+			return fmt.Errorf("node does not exists")
+		}
+		err := nodes.Delete([]byte(nodeName))
+		if err != nil {
+			return err
+		}
+
+		index := tx.Bucket(indexBucket)
+		return index.ForEach(func(k, v []byte) error {
+			b := index.Bucket(k)
+			if b == nil {
+				return nil
+			}
+			return b.Delete([]byte(nodeName))
+		})
+	})
+}
+
+// Write nodes statuses for items
+func (store *FileStorage) WriteIndex(hash string, nodeName string, ops int) error {
+
+	return store.DB.Update(func(tx *bolt.Tx) error {
+		index := tx.Bucket(indexBucket)
+
+		switch ops {
+		case Add:
+			b, err := index.CreateBucketIfNotExists([]byte(hash))
+			if err != nil {
+				return err
+			}
+			return incrScore(b, nodeName, 1)
+		case Remove:
+			b := index.Bucket([]byte(hash))
+			if b == nil {
+				return nil
+			}
+			return incrScore(b, nodeName, -1)
+		case Destroy:
+			b := index.Bucket([]byte(hash))
+			if b == nil {
+				return nil
+			}
+			return b.Delete([]byte(nodeName))
+		default:
+			return fmt.Errorf("store: invalid operation")
+		}
+	})
+}
+
+// Read node statuses for item
+func (store *FileStorage) ReadIndex(hash string) (map[string]int, error) {
+
+	_item := map[string]int{}
+
+	err := store.DB.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket(indexBucket).Bucket([]byte(hash))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			score, err := strconv.Atoi(string(v))
+			if err != nil {
+				return fmt.Errorf("invalid score for node %s: %v", string(k), err)
+			}
+			_item[string(k)] = score
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(_item) == 0 {
+		return nil, fmt.Errorf("item does not exist")
+	}
+	return _item, nil
+}
+
+func (store *FileStorage) ListItems(cursor string, limit int) ([]string, string, error) {
+
+	return store.scanItems(cursor, limit, func(b *bolt.Bucket) bool {
+		k, _ := b.Cursor().First()
+		return k != nil
+	})
+}
+
+// bbolt has no secondary indexes, this walks all the items
+func (store *FileStorage) ListNodeItems(nodeName string, cursor string, limit int) ([]string, string, error) {
+
+	return store.scanItems(cursor, limit, func(b *bolt.Bucket) bool {
+		return b.Get([]byte(nodeName)) != nil
+	})
+}
+
+// Walk the index in key order starting after cursor, collecting up to limit items that match
+func (store *FileStorage) scanItems(cursor string, limit int, match func(*bolt.Bucket) bool) ([]string, string, error) {
+
+	items := []string{}
+	next := ""
+
+	err := store.DB.View(func(tx *bolt.Tx) error {
+		index := tx.Bucket(indexBucket)
+		c := index.Cursor()
+
+		k, _ := c.Seek([]byte(cursor))
+		if k != nil && string(k) == cursor {
+			k, _ = c.Next()
+		}
+
+		for ; k != nil; k, _ = c.Next() {
+			b := index.Bucket(k)
+			if b == nil || !match(b) {
+				continue
+			}
+			if len(items) == limit {
+				next = items[len(items)-1]
+				break
+			}
+			items = append(items, string(k))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return items, next, nil
+}
+
+// Add delta to the score of a node, the caller must hold a write transaction
+func incrScore(b *bolt.Bucket, nodeName string, delta int) error {
+
+	score := 0
+	if v := b.Get([]byte(nodeName)); v != nil {
+		_score, err := strconv.Atoi(string(v))
+		if err != nil {
+			return fmt.Errorf("invalid score for node %s: %v", nodeName, err)
+		}
+		score = _score
+	}
+	return b.Put([]byte(nodeName), []byte(strconv.Itoa(score+delta)))
+}
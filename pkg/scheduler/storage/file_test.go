@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/ish-xyz/dcache/pkg/node"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupFileStorage(t *testing.T, path string) *FileStorage {
+	store, err := NewFileStorage(map[string]string{"path": path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestFileWriteReadNode(t *testing.T) {
+	store := setupFileStorage(t, filepath.Join(t.TempDir(), "scheduler.db"))
+	defer store.DB.Close()
+	_node := &node.NodeSchema{
+		Name:           "node1",
+		IPv4:           "10.0.0.1",
+		Port:           8100,
+		Scheme:         "http",
+		MaxConnections: 10,
+	}
+
+	writeErr := store.WriteNode(_node, false)
+	duplicateErr := store.WriteNode(_node, false)
+	readNode, readErr := store.ReadNode("node1")
+	_, missingErr := store.ReadNode("node2")
+
+	assert.Nil(t, writeErr)
+	assert.NotNil(t, duplicateErr)
+	assert.Nil(t, readErr)
+	assert.Equal(t, _node, readNode)
+	assert.NotNil(t, missingErr)
+}
+
+func TestFileIndexOperations(t *testing.T) {
+	store := setupFileStorage(t, filepath.Join(t.TempDir(), "scheduler.db"))
+	defer store.DB.Close()
+
+	store.WriteIndex("item1", "node1", Add)
+	store.WriteIndex("item1", "node1", Add)
+	store.WriteIndex("item1", "node2", Add)
+	added, addErr := store.ReadIndex("item1")
+
+	store.WriteIndex("item1", "node1", Remove)
+	store.WriteIndex("item1", "node2", Destroy)
+	updated, updateErr := store.ReadIndex("item1")
+
+	removeErr := store.WriteIndex("item2", "node1", Remove)
+	_, missingErr := store.ReadIndex("item2")
+
+	assert.Nil(t, addErr)
+	assert.Equal(t, map[string]int{"node1": 2, "node2": 1}, added)
+	assert.Nil(t, updateErr)
+	assert.Equal(t, map[string]int{"node1": 1}, updated)
+	assert.Nil(t, removeErr)
+	assert.NotNil(t, missingErr)
+}
+
+func TestFileSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scheduler.db")
+	store := setupFileStorage(t, path)
+	store.WriteNode(&node.NodeSchema{Name: "node1"}, false)
+	store.WriteIndex("item1", "node1", Add)
+	store.DB.Close()
+
+	store = setupFileStorage(t, path)
+	defer store.DB.Close()
+	_node, nodeErr := store.ReadNode("node1")
+	_item, itemErr := store.ReadIndex("item1")
+
+	assert.Nil(t, nodeErr)
+	assert.Equal(t, "node1", _node.Name)
+	assert.Nil(t, itemErr)
+	assert.Equal(t, map[string]int{"node1": 1}, _item)
+}
+
+func TestFileListDeleteNode(t *testing.T) {
+	store := setupFileStorage(t, filepath.Join(t.TempDir(), "scheduler.db"))
+	defer store.DB.Close()
+	store.WriteNode(&node.NodeSchema{Name: "node1"}, false)
+	store.WriteNode(&node.NodeSchema{Name: "node2"}, false)
+	store.WriteIndex("item1", "node1", Add)
+	store.WriteIndex("item1", "node2", Add)
+
+	deleteErr := store.DeleteNode("node1")
+	missingErr := store.DeleteNode("node1")
+	nodes, listErr := store.ListNodes()
+	_item, _ := store.ReadIndex("item1")
+
+	assert.Nil(t, deleteErr)
+	assert.NotNil(t, missingErr)
+	assert.Nil(t, listErr)
+	assert.Equal(t, []*node.NodeSchema{{Name: "node2"}}, nodes)
+	assert.Equal(t, map[string]int{"node2": 1}, _item)
+}
+
+func TestFileUpdateNode(t *testing.T) {
+	store := setupFileStorage(t, filepath.Join(t.TempDir(), "scheduler.db"))
+	defer store.DB.Close()
+	store.WriteNode(&node.NodeSchema{Name: "node1", Port: 8100}, false)
+
+	err := store.UpdateNode("node1", func(n *node.NodeSchema) error {
+		n.Port = 8200
+		return nil
+	})
+	failedErr := store.UpdateNode("node1", func(n *node.NodeSchema) error {
+		n.Port = 8300
+		return fmt.Errorf("invalid node")
+	})
+	missingErr := store.UpdateNode("node2", func(n *node.NodeSchema) error { return nil })
+	_node, _ := store.ReadNode("node1")
+
+	assert.Nil(t, err)
+	assert.NotNil(t, failedErr)
+	assert.NotNil(t, missingErr)
+	assert.Equal(t, 8200, _node.Port)
+}
+
+func TestFileListItems(t *testing.T) {
+	store := setupFileStorage(t, filepath.Join(t.TempDir(), "scheduler.db"))
+	defer store.DB.Close()
+	for _, item := range []string{"item3", "item1", "item2"} {
+		store.WriteIndex(item, "node1", Add)
+	}
+	store.WriteIndex("item4", "node2", Add)
+	store.WriteIndex("item2", "node1", Destroy)
+
+	firstPage, next, firstErr := store.ListItems("", 2)
+	secondPage, last, secondErr := store.ListItems(next, 2)
+	nodeItems, _, nodeErr := store.ListNodeItems("node1", "", 10)
+
+	assert.Nil(t, firstErr)
+	assert.Equal(t, []string{"item1", "item3"}, firstPage)
+	assert.Equal(t, "item3", next)
+	assert.Nil(t, secondErr)
+	assert.Equal(t, []string{"item4"}, secondPage)
+	assert.Equal(t, "", last)
+	assert.Nil(t, nodeErr)
+	assert.Equal(t, []string{"item1", "item3"}, nodeItems)
+}
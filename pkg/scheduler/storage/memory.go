@@ -44,6 +44,53 @@ func (store *MemoryStorage) ReadNode(nodeName string) (*node.NodeSchema, error)
 	return nil, fmt.Errorf("node does not exists")
 }
 
+func (store *MemoryStorage) ListNodes() ([]*node.NodeSchema, error) {
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	nodes := make([]*node.NodeSchema, 0, len(store.Nodes))
+	for _, node := range store.Nodes {
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
+
+func (store *MemoryStorage) UpdateNode(nodeName string, update func(*node.NodeSchema) error) error {
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	_node, ok := store.Nodes[nodeName]
+	if !ok {
+		return fmt.Errorf("node does not exists")
+	}
+
+	// work on a copy, so that a failed update leaves the node untouched
+	updated := *_node
+	err := update(&updated)
+	if err != nil {
+		return err
+	}
+	*_node = updated
+	return nil
+}
+
+func (store *MemoryStorage) DeleteNode(nodeName string) error {
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	if _, ok := store.Nodes[nodeName]; !ok {
+		return fmt.Errorf("node does not exists")
+	}
+	delete(store.Nodes, nodeName)
+	for hash := range store.Index {
+		delete(store.Index[hash], nodeName)
+	}
+	return nil
+}
+
 // Write nodes statuses for items
 func (store *MemoryStorage) WriteIndex(hash string, nodeName string, ops int) error {
 
@@ -86,3 +133,33 @@ func (store *MemoryStorage) ReadIndex(hash string) (map[string]int, error) {
 	}
 	return nil, fmt.Errorf("item does not exist")
 }
+
+func (store *MemoryStorage) ListItems(cursor string, limit int) ([]string, string, error) {
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	keys := []string{}
+	for hash, nodes := range store.Index {
+		if len(nodes) > 0 {
+			keys = append(keys, hash)
+		}
+	}
+	items, next := paginate(keys, cursor, limit)
+	return items, next, nil
+}
+
+func (store *MemoryStorage) ListNodeItems(nodeName string, cursor string, limit int) ([]string, string, error) {
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	keys := []string{}
+	for hash, nodes := range store.Index {
+		if _, ok := nodes[nodeName]; ok {
+			keys = append(keys, hash)
+		}
+	}
+	items, next := paginate(keys, cursor, limit)
+	return items, next, nil
+}
@@ -0,0 +1,309 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/ish-xyz/dcache/pkg/node"
+)
+
+const (
+	defaultRedisAddress = "localhost:6379"
+	defaultRedisPrefix  = "dcache"
+	maxTxRetries        = 10
+)
+
+// Decrement the node score only if the item is already indexed,
+// same behaviour as the memory storage
+var removeScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 1 then
+	return redis.call("HINCRBY", KEYS[1], ARGV[1], -1)
+end
+return 0
+`)
+
+// Remove the node from the item and keep the sorted sets used for listings in sync
+var destroyScript = redis.NewScript(`
+redis.call("HDEL", KEYS[1], ARGV[1])
+redis.call("ZREM", KEYS[3], ARGV[2])
+if redis.call("HLEN", KEYS[1]) == 0 then
+	redis.call("ZREM", KEYS[2], ARGV[2])
+end
+return 0
+`)
+
+type RedisStorage struct {
+	Client *redis.Client
+	Prefix string
+	ctx    context.Context
+}
+
+// Initialise redis storage, supported options are:
+// address, password, db and prefix
+func NewRedisStorage(opts map[string]string) (*RedisStorage, error) {
+
+	address := defaultRedisAddress
+	if v, ok := opts["address"]; ok && v != "" {
+		address = v
+	}
+
+	prefix := defaultRedisPrefix
+	if v, ok := opts["prefix"]; ok && v != "" {
+		prefix = v
+	}
+
+	db := 0
+	if v, ok := opts["db"]; ok && v != "" {
+		_db, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid redis db %s: %v", v, err)
+		}
+		db = _db
+	}
+
+	client := redis.NewClient(&redis.Options{
+		Addr:     address,
+		Password: opts["password"],
+		DB:       db,
+	})
+
+	store := &RedisStorage{
+		Client: client,
+		Prefix: prefix,
+		ctx:    context.Background(),
+	}
+
+	err := client.Ping(store.ctx).Err()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to redis on %s: %v", address, err)
+	}
+
+	return store, nil
+}
+
+func (store *RedisStorage) nodesKey() string {
+	return fmt.Sprintf("%s:nodes", store.Prefix)
+}
+
+func (store *RedisStorage) indexKey(hash string) string {
+	return fmt.Sprintf("%s:index:%s", store.Prefix, hash)
+}
+
+// Sorted set of all the items, used to paginate listings
+func (store *RedisStorage) itemsKey() string {
+	return fmt.Sprintf("%s:items", store.Prefix)
+}
+
+// Sorted set of the items held by a node, used to paginate listings
+func (store *RedisStorage) nodeItemsKey(nodeName string) string {
+	return fmt.Sprintf("%s:nodeitems:%s", store.Prefix, nodeName)
+}
+
+func (store *RedisStorage) destroy(hash, nodeName string) error {
+	keys := []string{store.indexKey(hash), store.itemsKey(), store.nodeItemsKey(nodeName)}
+	return destroyScript.Run(store.ctx, store.Client, keys, nodeName, hash).Err()
+}
+
+func (store *RedisStorage) WriteNode(node *node.NodeSchema, force bool) error {
+
+	payload, err := json.Marshal(node)
+	if err != nil {
+		return err
+	}
+
+	if force {
+		return store.Client.HSet(store.ctx, store.nodesKey(), node.Name, payload).Err()
+	}
+
+	created, err := store.Client.HSetNX(store.ctx, store.nodesKey(), node.Name, payload).Result()
+	if err != nil {
+		return err
+	}
+	if !created {
+		return fmt.Errorf("node already exists")
+	}
+	return nil
+}
+
+func (store *RedisStorage) ReadNode(nodeName string) (*node.NodeSchema, error) {
+
+	var _node node.NodeSchema
+
+	payload, err := store.Client.HGet(store.ctx, store.nodesKey(), nodeName).Bytes()
+	if err == redis.Nil {
+		return nil, fmt.Errorf("node does not exists")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(payload, &_node)
+	if err != nil {
+		return nil, err
+	}
+	return &_node, nil
+}
+
+func (store *RedisStorage) ListNodes() ([]*node.NodeSchema, error) {
+
+	values, err := store.Client.HGetAll(store.ctx, store.nodesKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make([]*node.NodeSchema, 0, len(values))
+	for nodeName, payload := range values {
+		var _node node.NodeSchema
+		err := json.Unmarshal([]byte(payload), &_node)
+		if err != nil {
+			return nil, fmt.Errorf("invalid payload for node %s: %v", nodeName, err)
+		}
+		nodes = append(nodes, &_node)
+	}
+	return nodes, nil
+}
+
+func (store *RedisStorage) UpdateNode(nodeName string, update func(*node.NodeSchema) error) error {
+
+	key := store.nodesKey()
+	txf := func(tx *redis.Tx) error {
+		var _node node.NodeSchema
+
+		payload, err := tx.HGet(store.ctx, key, nodeName).Bytes()
+		if err == redis.Nil {
+			return fmt.Errorf("node does not exists")
+		}
+		if err != nil {
+			return err
+		}
+		err = json.Unmarshal(payload, &_node)
+		if err != nil {
+			return err
+		}
+
+		err = update(&_node)
+		if err != nil {
+			return err
+		}
+		payload, err = json.Marshal(&_node)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(store.ctx, func(pipe redis.Pipeliner) error {
+			return pipe.HSet(store.ctx, key, nodeName, payload).Err()
+		})
+		return err
+	}
+
+	// optimistic locking, retry if the nodes have been modified in the meantime
+	for i := 0; i < maxTxRetries; i++ {
+		err := store.Client.Watch(store.ctx, txf, key)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return fmt.Errorf("failed to update node %s, too many concurrent updates", nodeName)
+}
+
+func (store *RedisStorage) DeleteNode(nodeName string) error {
+
+	deleted, err := store.Client.HDel(store.ctx, store.nodesKey(), nodeName).Result()
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return fmt.Errorf("node does not exists")
+	}
+
+	items, err := store.Client.ZRange(store.ctx, store.nodeItemsKey(nodeName), 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	for _, hash := range items {
+		err := store.destroy(hash, nodeName)
+		if err != nil {
+			return err
+		}
+	}
+	return store.Client.Del(store.ctx, store.nodeItemsKey(nodeName)).Err()
+}
+
+// Write nodes statuses for items
+func (store *RedisStorage) WriteIndex(hash string, nodeName string, ops int) error {
+
+	key := store.indexKey(hash)
+
+	switch ops {
+	case Add:
+		_, err := store.Client.TxPipelined(store.ctx, func(pipe redis.Pipeliner) error {
+			pipe.HIncrBy(store.ctx, key, nodeName, 1)
+			pipe.ZAdd(store.ctx, store.itemsKey(), &redis.Z{Member: hash})
+			pipe.ZAdd(store.ctx, store.nodeItemsKey(nodeName), &redis.Z{Member: hash})
+			return nil
+		})
+		return err
+	case Remove:
+		return removeScript.Run(store.ctx, store.Client, []string{key}, nodeName).Err()
+	case Destroy:
+		return store.destroy(hash, nodeName)
+	default:
+		return fmt.Errorf("store: invalid operation")
+	}
+}
+
+// Read node statuses for item
+func (store *RedisStorage) ReadIndex(hash string) (map[string]int, error) {
+
+	values, err := store.Client.HGetAll(store.ctx, store.indexKey(hash)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(values) == 0 {
+		return nil, fmt.Errorf("item does not exist")
+	}
+
+	_item := make(map[string]int, len(values))
+	for nodeName, score := range values {
+		_score, err := strconv.Atoi(score)
+		if err != nil {
+			return nil, fmt.Errorf("invalid score for node %s: %v", nodeName, err)
+		}
+		_item[nodeName] = _score
+	}
+	return _item, nil
+}
+
+func (store *RedisStorage) ListItems(cursor string, limit int) ([]string, string, error) {
+	return store.rangeItems(store.itemsKey(), cursor, limit)
+}
+
+func (store *RedisStorage) ListNodeItems(nodeName string, cursor string, limit int) ([]string, string, error) {
+	return store.rangeItems(store.nodeItemsKey(nodeName), cursor, limit)
+}
+
+// All members have the same score, so they are sorted lexicographically
+func (store *RedisStorage) rangeItems(key string, cursor string, limit int) ([]string, string, error) {
+
+	from := "-"
+	if cursor != "" {
+		from = "(" + cursor
+	}
+
+	items, err := store.Client.ZRangeByLex(store.ctx, key, &redis.ZRangeBy{
+		Min:   from,
+		Max:   "+",
+		Count: int64(limit + 1),
+	}).Result()
+	if err != nil {
+		return nil, "", err
+	}
+
+	if len(items) > limit {
+		return items[:limit], items[limit-1], nil
+	}
+	return items, "", nil
+}
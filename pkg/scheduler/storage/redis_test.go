@@ -0,0 +1,169 @@
+package storage
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/ish-xyz/dcache/pkg/node"
+	"github.com/stretchr/testify/assert"
+)
+
+func setupRedisStorage(t *testing.T) *RedisStorage {
+	srv := miniredis.RunT(t)
+	store, err := NewRedisStorage(map[string]string{
+		"address": srv.Addr(),
+		"prefix":  "dcache-tests",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
+
+func TestRedisWriteReadNode(t *testing.T) {
+	store := setupRedisStorage(t)
+	_node := &node.NodeSchema{
+		Name:           "node1",
+		IPv4:           "10.0.0.1",
+		Port:           8100,
+		Scheme:         "http",
+		MaxConnections: 10,
+	}
+
+	writeErr := store.WriteNode(_node, false)
+	readNode, readErr := store.ReadNode("node1")
+
+	assert.Nil(t, writeErr)
+	assert.Nil(t, readErr)
+	assert.Equal(t, _node, readNode)
+}
+
+func TestRedisWriteNodeAlreadyExists(t *testing.T) {
+	store := setupRedisStorage(t)
+	_node := &node.NodeSchema{Name: "node1"}
+
+	firstErr := store.WriteNode(_node, false)
+	secondErr := store.WriteNode(_node, false)
+	forceErr := store.WriteNode(_node, true)
+
+	assert.Nil(t, firstErr)
+	assert.NotNil(t, secondErr)
+	assert.Nil(t, forceErr)
+}
+
+func TestRedisReadNodeNotFound(t *testing.T) {
+	store := setupRedisStorage(t)
+
+	_node, err := store.ReadNode("missing")
+
+	assert.Nil(t, _node)
+	assert.NotNil(t, err)
+}
+
+func TestRedisIndexOperations(t *testing.T) {
+	store := setupRedisStorage(t)
+
+	store.WriteIndex("item1", "node1", Add)
+	store.WriteIndex("item1", "node1", Add)
+	store.WriteIndex("item1", "node2", Add)
+	added, addErr := store.ReadIndex("item1")
+
+	store.WriteIndex("item1", "node1", Remove)
+	removed, removeErr := store.ReadIndex("item1")
+
+	store.WriteIndex("item1", "node2", Destroy)
+	destroyed, destroyErr := store.ReadIndex("item1")
+
+	assert.Nil(t, addErr)
+	assert.Equal(t, map[string]int{"node1": 2, "node2": 1}, added)
+	assert.Nil(t, removeErr)
+	assert.Equal(t, map[string]int{"node1": 1, "node2": 1}, removed)
+	assert.Nil(t, destroyErr)
+	assert.Equal(t, map[string]int{"node1": 1}, destroyed)
+}
+
+func TestRedisIndexRemoveMissingItem(t *testing.T) {
+	store := setupRedisStorage(t)
+
+	removeErr := store.WriteIndex("item1", "node1", Remove)
+	_item, readErr := store.ReadIndex("item1")
+
+	assert.Nil(t, removeErr)
+	assert.Nil(t, _item)
+	assert.NotNil(t, readErr)
+}
+
+func TestRedisIndexInvalidOperation(t *testing.T) {
+	store := setupRedisStorage(t)
+
+	err := store.WriteIndex("item1", "node1", 99)
+
+	assert.NotNil(t, err)
+}
+
+func TestRedisListDeleteNode(t *testing.T) {
+	store := setupRedisStorage(t)
+	store.WriteNode(&node.NodeSchema{Name: "node1"}, false)
+	store.WriteNode(&node.NodeSchema{Name: "node2"}, false)
+	store.WriteIndex("item1", "node1", Add)
+	store.WriteIndex("item1", "node2", Add)
+
+	deleteErr := store.DeleteNode("node1")
+	missingErr := store.DeleteNode("node1")
+	nodes, listErr := store.ListNodes()
+	_item, _ := store.ReadIndex("item1")
+
+	assert.Nil(t, deleteErr)
+	assert.NotNil(t, missingErr)
+	assert.Nil(t, listErr)
+	assert.Equal(t, []*node.NodeSchema{{Name: "node2"}}, nodes)
+	assert.Equal(t, map[string]int{"node2": 1}, _item)
+}
+
+func TestRedisUpdateNode(t *testing.T) {
+	store := setupRedisStorage(t)
+	store.WriteNode(&node.NodeSchema{Name: "node1", Port: 8100}, false)
+
+	err := store.UpdateNode("node1", func(n *node.NodeSchema) error {
+		n.Port = 8200
+		return nil
+	})
+	failedErr := store.UpdateNode("node1", func(n *node.NodeSchema) error {
+		n.Port = 8300
+		return fmt.Errorf("invalid node")
+	})
+	missingErr := store.UpdateNode("node2", func(n *node.NodeSchema) error { return nil })
+	_node, _ := store.ReadNode("node1")
+
+	assert.Nil(t, err)
+	assert.NotNil(t, failedErr)
+	assert.NotNil(t, missingErr)
+	assert.Equal(t, 8200, _node.Port)
+}
+
+func TestRedisListItems(t *testing.T) {
+	store := setupRedisStorage(t)
+	store.WriteNode(&node.NodeSchema{Name: "node1"}, false)
+	for _, item := range []string{"item3", "item1", "item2"} {
+		store.WriteIndex(item, "node1", Add)
+	}
+	store.WriteIndex("item4", "node2", Add)
+	store.WriteIndex("item2", "node1", Destroy)
+
+	firstPage, next, firstErr := store.ListItems("", 2)
+	secondPage, last, secondErr := store.ListItems(next, 2)
+	nodeItems, _, nodeErr := store.ListNodeItems("node1", "", 10)
+	store.DeleteNode("node1")
+	afterDelete, _, _ := store.ListItems("", 10)
+
+	assert.Nil(t, firstErr)
+	assert.Equal(t, []string{"item1", "item3"}, firstPage)
+	assert.Equal(t, "item3", next)
+	assert.Nil(t, secondErr)
+	assert.Equal(t, []string{"item4"}, secondPage)
+	assert.Equal(t, "", last)
+	assert.Nil(t, nodeErr)
+	assert.Equal(t, []string{"item1", "item3"}, nodeItems)
+	assert.Equal(t, []string{"item4"}, afterDelete)
+}
@@ -2,6 +2,7 @@ package storage
 
 import (
 	"fmt"
+	"sort"
 
 	"github.com/ish-xyz/dcache/pkg/node"
 )
@@ -10,13 +11,24 @@ import (
 type Storage interface {
 	WriteNode(node *node.NodeSchema, force bool) error
 	ReadNode(nodeName string) (*node.NodeSchema, error)
+	ListNodes() ([]*node.NodeSchema, error)
+	// atomic read-modify-write of a node
+	UpdateNode(nodeName string, update func(*node.NodeSchema) error) error
+	// delete node and remove it from the index
+	DeleteNode(nodeName string) error
 	WriteIndex(hash string, nodeName string, ops int) error
 	ReadIndex(hash string) (map[string]int, error)
+	// list items sorted by hash, starting after cursor,
+	// returns the cursor for the next page (empty if there are no more items)
+	ListItems(cursor string, limit int) ([]string, string, error)
+	// same as ListItems, but only for items held by a node
+	ListNodeItems(nodeName string, cursor string, limit int) ([]string, string, error)
 }
 
 // Initialise storage for scheduler
 func NewStorage(storageType string, opts map[string]string) (Storage, error) {
-	if storageType == "memory" {
+	switch storageType {
+	case "memory":
 		indexStore := map[string]map[string]int{
 			"init": {
 				"init": 1,
@@ -27,7 +39,27 @@ func NewStorage(storageType string, opts map[string]string) (Storage, error) {
 			Index: indexStore,
 			Nodes: map[string]*node.NodeSchema{},
 		}, nil
+	case "redis":
+		return NewRedisStorage(opts)
+	case "file":
+		return NewFileStorage(opts)
 	}
 
 	return nil, fmt.Errorf("invalid backend type")
 }
+
+// Return a page of sorted keys starting after cursor, and the cursor for the next page
+func paginate(keys []string, cursor string, limit int) ([]string, string) {
+
+	sort.Strings(keys)
+	start := sort.SearchStrings(keys, cursor)
+	if start < len(keys) && keys[start] == cursor {
+		start++
+	}
+
+	end := start + limit
+	if end >= len(keys) {
+		return keys[start:], ""
+	}
+	return keys[start:end], keys[end-1]
+}